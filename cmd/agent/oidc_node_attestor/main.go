@@ -31,8 +31,9 @@ func main() {
 		for {
 			<-sigCh
 			log.Print("plugin received interrupt signal, shutdown oidc client")
-			ctx, _:= context.WithTimeout(context.Background(), 5*time.Second)
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 			oidcNodeAttestorPlugin.Shutdown(ctx)
+			cancel()
 			doneCh<- struct{}{}
 		}
 	}()
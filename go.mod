@@ -11,6 +11,7 @@ require (
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
 	github.com/skratchdot/open-golang v0.0.0-20190402232053-79abb63cd66e
 	github.com/spiffe/spire v0.0.0-20190211235429-81bbb8e55b7d
-	golang.org/x/net v0.0.0-20190514140710-3ec191127204 // indirect
+	golang.org/x/net v0.0.0-20190514140710-3ec191127204
 	golang.org/x/oauth2 v0.0.0-20190402181905-9f3314589c9a
+	gopkg.in/square/go-jose.v2 v2.1.8
 )
@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/common"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/config"
+	"github.com/everpeace/oidc_attestor_plugin/pkg/oidcutil"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/hcl"
 	spi "github.com/spiffe/spire/proto/common/plugin"
 )
 
 type Config struct {
-	config.Agent     `hcl:",squash"`
-	common.IDGenMode `hcl:",squash"`
+	config.Agent           `hcl:",squash"`
+	common.IDGenMode       `hcl:",squash"`
+	common.HostFactsConfig `hcl:",squash"`
 }
 
 func (c *Config) Validate() (err error) {
@@ -23,10 +25,71 @@ func (c *Config) Validate() (err error) {
 	if _err := c.IDGenMode.Validate(); _err != nil {
 		err = multierror.Append(err, _err)
 	}
+	if _err := c.IDGenMode.ValidateIssuerAlias(c.IssuerAlias); _err != nil {
+		err = multierror.Append(err, _err)
+	}
+
+	if _err := c.HostFactsConfig.Validate(); _err != nil {
+		err = multierror.Append(err, _err)
+	}
+
+	if _err := common.ValidateTrustDomain(c.TrustDomain); c.TrustDomain != "" && _err != nil {
+		err = multierror.Append(err, _err)
+	}
+
+	if c.IssuerTemplate != "" {
+		if _, _err := oidcutil.NewIssuerTemplate(c.IssuerTemplate); _err != nil {
+			err = multierror.Append(err, _err)
+		}
+	}
+
+	if c.LegacyAttestationData && (c.NodeIDSource != "" || len(c.HostFacts) > 0) {
+		err = multierror.Append(err, errors.New("legacy_attestation_data can't be used with node_id_source or host_facts"))
+	}
+
+	switch c.NodeIDSource {
+	case "":
+		if c.RequiresNodeID() {
+			err = multierror.Append(err, fmt.Errorf("node_id_source must not be empty for mode %s", c.Mode))
+		}
+	case common.NodeIDSourceInstanceID:
+		if c.InstanceIDFile == "" {
+			err = multierror.Append(err, errors.New("instance_id_file must not be empty"))
+		}
+	case common.NodeIDSourceMachineID:
+	default:
+		err = multierror.Append(err, fmt.Errorf("node_id_source must be one of %s,%s",
+			common.NodeIDSourceInstanceID, common.NodeIDSourceMachineID,
+		))
+	}
 
 	return
 }
 
+func (c *Config) NewClientAuth() (oidcutil.ClientAuth, error) {
+	switch c.ClientAuthMethod {
+	case config.ClientAuthMethodPrivateKeyJWT:
+		return oidcutil.NewPrivateKeyJWTAuth(c.ClientAssertionKeyFile, c.ClientAssertionKeyID)
+	case config.ClientAuthMethodTLSClientAuth:
+		return oidcutil.NewTLSClientAuth(c.TLSClientCertFile, c.TLSClientKeyFile)
+	default:
+		return oidcutil.NewClientSecretAuth(c.clientSecretSource()), nil
+	}
+}
+
+func (c *Config) clientSecretSource() oidcutil.SecretSource {
+	switch {
+	case c.ClientSecretFile != "":
+		return oidcutil.FileSecret(c.ClientSecretFile)
+	case c.ClientSecretEnv != "":
+		return oidcutil.EnvSecret(c.ClientSecretEnv)
+	case len(c.ClientSecretCommand) > 0:
+		return oidcutil.CommandSecret(c.ClientSecretCommand)
+	default:
+		return oidcutil.StaticSecret(c.ClientSecret)
+	}
+}
+
 func NewConfig(req *spi.ConfigureRequest) (*Config, error) {
 	config := &Config{}
 	if err := hcl.Decode(config, req.Configuration); err != nil {
@@ -37,6 +100,7 @@ func NewConfig(req *spi.ConfigureRequest) (*Config, error) {
 		return nil, errors.New("global configuration is required")
 	}
 	config.TrustDomain = req.GlobalConfig.TrustDomain
+	config.SetDefaults()
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -2,14 +2,18 @@ package nodeattestor
 
 import (
 	"context"
+	"crypto"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"github.com/everpeace/oidc_attestor_plugin/pkg"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/common"
+	"github.com/everpeace/oidc_attestor_plugin/pkg/config"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/oidcutil"
 	"github.com/spiffe/spire/proto/agent/nodeattestor"
+	"io"
 	"log"
 	"sync"
-	"time"
 
 	spc "github.com/spiffe/spire/proto/common"
 	spi "github.com/spiffe/spire/proto/common/plugin"
@@ -21,7 +25,11 @@ type Plugin struct {
 	mtx *sync.RWMutex
 
 	config *Config
+	nodeID string
+	hmacKey []byte
+	issuerTemplate *oidcutil.IssuerTemplate
 	client *oidcutil.Client
+	tokenSource oidcutil.TokenSource
 }
 
 func New() *Plugin {
@@ -40,20 +48,73 @@ func (p *Plugin) FetchAttestationData(stream nodeattestor.FetchAttestationData_P
 		return errors.New("plugin not configured")
 	}
 
-	ctx, _ := context.WithTimeout(context.Background(), 60 * time.Second)
-	t, err := p.client.Authenticate(ctx)
+	ctx, cancel := context.WithTimeout(stream.Context(), p.config.FetchTimeout())
+	defer cancel()
+	t, err := p.tokenSource.Token(ctx)
 
 	if err != nil {
 		return err
 	}
 
-	spiffeId := p.config.GenerateSpiffeId(p.config.TrustDomain, t.Claims)
+	if p.issuerTemplate != nil {
+		if err := p.issuerTemplate.ResolveTenant(t.Claims); err != nil {
+			return err
+		}
+	}
+
+	if err := p.config.CanonicalizeEmail(t.Claims); err != nil {
+		return err
+	}
+
+	spiffeId := ""
+	if p.config.IsHashed() && p.hmacKey == nil {
+		log.Print("INFO: hmac_key_file isn't set, skipping preview of hashed SPIFFE ID")
+	} else {
+		spiffeId, err = p.config.GenerateSpiffeId(common.IDInput{
+			TrustDomain: p.config.TrustDomain,
+			IssuerAlias: p.config.IssuerAlias,
+			Claims:      t.Claims,
+			NodeID:      p.nodeID,
+			HMACKey:     p.hmacKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
 	log.Printf("DEBUG: spiffeID=%s", spiffeId)
 
+	attestationData := &common.AttestationData{
+		IDToken:       t.RawIDToken,
+		PluginVersion: pkg.Version,
+		HostFacts:     common.CollectHostFacts(p.config.HostFacts),
+		NodeID:        p.nodeID,
+	}
+	if t.Certificate != nil {
+		attestationData.Certificate = t.Certificate.Certificate[0]
+	}
+	if p.config.SendAccessToken {
+		attestationData.AccessToken = t.AccessToken
+	}
+	if p.config.UsesAccessToken() {
+		if t.AccessToken == "" {
+			return errors.New("token source didn't return access token")
+		}
+		attestationData.IDToken = ""
+		attestationData.AccessToken = t.AccessToken
+	}
+	marshal := attestationData.Marshal
+	if p.config.LegacyAttestationData {
+		marshal = attestationData.MarshalLegacy
+	}
+	data, err := marshal()
+	if err != nil {
+		return err
+	}
+
 	resp := &nodeattestor.FetchAttestationDataResponse{
 		AttestationData: &spc.AttestationData{
-			Type: pkg.PluginName,
-			Data: []byte(t.RawIDToken),
+			Type: p.config.PluginName,
+			Data: data,
 		},
 		SpiffeId: spiffeId,
 	}
@@ -61,11 +122,48 @@ func (p *Plugin) FetchAttestationData(stream nodeattestor.FetchAttestationData_P
 		log.Fatal("failed sending FetchAttestationDataResponse", err)
 		return err
 	}
+	if t.Certificate != nil {
+		if err := answerChallenge(stream, t.Certificate, spiffeId); err != nil {
+			return err
+		}
+	}
 
 	log.Print("DEBUG: start FetchAttestationData")
 	return nil
 }
 
+// answerChallenge signs the server's nonce with the key of the certificate which the token is bound to.
+// The server doesn't send a challenge unless it verifies certificate binding.
+func answerChallenge(stream nodeattestor.FetchAttestationData_PluginStream, cert *tls.Certificate, spiffeId string) error {
+	req, err := stream.Recv()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	challenge, err := common.ParseChallenge(req.Challenge)
+	if err != nil {
+		return err
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return errors.New("tls client certificate key can't sign challenge")
+	}
+	answer, err := common.SignChallenge(key, challenge)
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	return stream.Send(&nodeattestor.FetchAttestationDataResponse{
+		SpiffeId: spiffeId,
+		Response: b,
+	})
+}
+
 func (p *Plugin) Configure(ctx context.Context, req *spi.ConfigureRequest) (*spi.ConfigureResponse, error) {
 	p.mtx.Lock()
 	defer p.mtx.Unlock()
@@ -78,21 +176,137 @@ func (p *Plugin) Configure(ctx context.Context, req *spi.ConfigureRequest) (*spi
 
 	p.config = config
 	verifiedEmailClaimCheck := false
-	if p.config.Mode == common.IDGenModeEmail {
+	if p.config.RequiresEmail() {
 		verifiedEmailClaimCheck = true
 	}
-	client, err := oidcutil.NewClient(
-		p.config.IssuerURL, p.config.ClientID, p.config.ClientSecret, verifiedEmailClaimCheck,
-	)
+	p.hmacKey = nil
+	if p.config.HMACKeyFile != "" {
+		key, err := common.LoadHMACKey(p.config.HMACKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		p.hmacKey = key
+	}
+	p.issuerTemplate = nil
+	if p.config.IssuerTemplate != "" {
+		template, err := oidcutil.NewIssuerTemplate(p.config.IssuerTemplate)
+		if err != nil {
+			return nil, err
+		}
+		p.issuerTemplate = template
+	}
+	p.nodeID = ""
+	if p.config.NodeIDSource != "" {
+		nodeID, err := common.LoadNodeID(p.config.NodeIDSource, p.config.InstanceIDFile)
+		if err != nil {
+			return nil, err
+		}
+		p.nodeID = nodeID
+	}
+	// the callback server of the previous client holds the callback port the new client listens on
+	if p.client != nil {
+		if err := p.client.Shutdown(ctx); err != nil {
+			log.Printf("ERROR: failed to shutdown previous client: %s", err)
+		}
+		p.client = nil
+	}
+	if p.config.UsesOAuthClient() {
+		client, err := p.newClient(ctx, verifiedEmailClaimCheck)
+		if err != nil {
+			return nil, err
+		}
+		if p.config.UsesAccessToken() {
+			client.SetResource(p.config.Resource)
+		}
+		if p.config.RefreshTokenCacheFile != "" {
+			client.SetTokenCacheFile(p.config.RefreshTokenCacheFile)
+		}
+		p.client = client
+	}
+
+	tokenSource, err := p.newTokenSource(verifiedEmailClaimCheck)
 	if err != nil {
 		return nil, err
 	}
-	p.client = client
+	p.tokenSource = tokenSource
 
 	log.Print("DEBUG: finish Configure")
 	return &spi.ConfigureResponse{}, nil
 }
 
+// newTokenSource builds the token sources in the configured order.
+func (p *Plugin) newTokenSource(verifiedEmailClaimCheck bool) (oidcutil.TokenSource, error) {
+	var verifier *oidcutil.Verifier
+	var sources []oidcutil.TokenSource
+	for _, name := range p.config.TokenSourceNames() {
+		if !config.IsOAuthClientTokenSource(name) && verifier == nil {
+			var err error
+			verifier, err = oidcutil.NewVerifierForIssuer(
+				context.Background(), p.config.IssuerURL, p.config.ExpectedAudience(), p.config.JWKSFile,
+				verifiedEmailClaimCheck,
+			)
+			if err != nil {
+				return nil, err
+			}
+		}
+		switch name {
+		case config.TokenSourceTokenFile:
+			sources = append(sources, oidcutil.NewFileTokenSource(verifier, p.config.TokenFile))
+		case config.TokenSourceKubernetes:
+			sources = append(sources, oidcutil.NewKubernetesTokenSource(verifier, p.config.KubernetesTokenPathName()))
+		case config.TokenSourceGCE:
+			sources = append(sources, oidcutil.NewGCETokenSource(
+				verifier, p.config.GCEMetadataURLOrDefault(), p.config.ExpectedAudience(),
+			))
+		case config.TokenSourceAzure:
+			sources = append(sources, oidcutil.NewAzureTokenSource(
+				verifier, p.config.AzureIMDSURLOrDefault(), p.config.ExpectedAudience(),
+			))
+		case config.TokenSourceExec:
+			timeout, _ := p.config.Exec.TimeoutDuration()
+			sources = append(sources, oidcutil.NewExecTokenSource(
+				verifier, p.config.Exec.Command, p.config.Exec.Args, p.config.Exec.Env, timeout,
+			))
+		case config.TokenSourceRefreshToken:
+			sources = append(sources, p.client.RefreshTokenSource(p.config.RefreshTokenCacheFile))
+		case config.TokenSourceDeviceCode:
+			sources = append(sources, p.client.DeviceCodeTokenSource())
+		case config.TokenSourceBrowser:
+			sources = append(sources, p.client.BrowserTokenSource())
+		case config.TokenSourceGitHubActions:
+			sources = append(sources, oidcutil.NewGitHubActionsTokenSource(verifier, p.config.ExpectedAudience()))
+		case config.TokenSourceGitLabCI:
+			sources = append(sources, oidcutil.NewGitLabCITokenSource(verifier, p.config.GitLabIDTokenVariableName()))
+		}
+	}
+	return oidcutil.NewChainTokenSource(sources...), nil
+}
+
+func (p *Plugin) newClient(ctx context.Context, verifiedEmailClaimCheck bool) (*oidcutil.Client, error) {
+	clientID, callbackPort := p.config.ClientID, 0
+	var auth oidcutil.ClientAuth
+	if p.config.DynamicRegistrationEnabled() {
+		reg, err := oidcutil.LoadOrRegisterClient(
+			ctx, p.config.IssuerURL, p.config.RegistrationInitialAccessToken, p.config.RegistrationStateFile,
+			p.config.RegistrationSoftwareID,
+		)
+		if err != nil {
+			return nil, err
+		}
+		clientID, callbackPort = reg.ClientID, reg.CallbackPort
+		auth = oidcutil.NewClientSecretAuth(oidcutil.StaticSecret(reg.ClientSecret))
+	} else {
+		var err error
+		auth, err = p.config.NewClientAuth()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return oidcutil.NewClient(
+		p.config.IssuerURL, clientID, auth, callbackPort, verifiedEmailClaimCheck,
+	)
+}
+
 func (p *Plugin) GetPluginInfo(context.Context, *spi.GetPluginInfoRequest) (*spi.GetPluginInfoResponse, error) {
 	return &spi.GetPluginInfoResponse{}, nil
 }
@@ -103,14 +317,15 @@ func (p *Plugin) Shutdown(ctx context.Context) {
 	if p.client == nil {
 		return
 	}
-	childCtx, _ := context.WithCancel(ctx)
+	childCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
 	if err := p.client.Shutdown(childCtx); err != nil {
-		log.Fatal(err)
+		log.Printf("ERROR: failed to shutdown client: %s", err)
 	}
 }
 
 func (p *Plugin) assertConfigured() error {
-	if p.config == nil || p.client == nil {
+	if p.config == nil || p.tokenSource == nil {
 		return errors.New("plugin not configured")
 	}
 	return nil
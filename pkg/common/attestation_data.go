@@ -0,0 +1,126 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// raw id token, or json carrying tokens without version
+	AttestationDataVersionLegacy = 0
+	// envelope which can also carry host facts, node id and the agent plugin version,
+	// and whose attestation can be followed by nonce challenges
+	AttestationDataVersion1 = 1
+
+	// latest version sent by the agent plugin and understood by the server plugin
+	AttestationDataVersion = AttestationDataVersion1
+)
+
+// AttestationData is the payload sent from the agent plugin to the server plugin.
+// The agent sends the latest versioned envelope unless legacy_attestation_data is set,
+// and the server accepts legacy payloads as well.
+type AttestationData struct {
+	Version     int    `json:"version"`
+	IDToken     string `json:"id_token,omitempty"`
+	AccessToken string `json:"access_token,omitempty"`
+
+	// fields below are available since AttestationDataVersion1
+	// DER encoded client certificate which the token is bound to, whose key is challenged by the server
+	Certificate   []byte            `json:"certificate,omitempty"`
+	HostFacts     map[string]string `json:"host_facts,omitempty"`
+	PluginVersion string            `json:"plugin_version,omitempty"`
+	// stable id of the agent's node, asserted by the agent
+	NodeID string `json:"node_id,omitempty"`
+}
+
+// Marshal encodes the latest envelope.
+func (d *AttestationData) Marshal() ([]byte, error) {
+	d.Version = AttestationDataVersion
+	return json.Marshal(d)
+}
+
+// MarshalLegacy encodes the raw id token, which servers without versioned payloads accept.
+func (d *AttestationData) MarshalLegacy() ([]byte, error) {
+	if d.IDToken == "" || d.AccessToken != "" || len(d.Certificate) > 0 || len(d.HostFacts) > 0 || d.NodeID != "" {
+		return nil, errors.New("legacy attestation data can carry nothing but id token")
+	}
+	d.Version = AttestationDataVersionLegacy
+	return []byte(d.IDToken), nil
+}
+
+// Challenge is sent by the server after versioned attestation data, when it needs the agent to prove something,
+// e.g. possession of the key of the certificate which the token is bound to.
+type Challenge struct {
+	Nonce []byte `json:"nonce"`
+}
+
+// ChallengeResponse is the agent's answer to Challenge.
+type ChallengeResponse struct {
+	NonceResponse []byte `json:"nonce_response"`
+}
+
+const challengeNonceSize = 32
+
+func NewChallenge() (*Challenge, error) {
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &Challenge{Nonce: nonce}, nil
+}
+
+func ParseChallenge(b []byte) (*Challenge, error) {
+	c := &Challenge{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("malformed challenge: %v", err)
+	}
+	if len(c.Nonce) != challengeNonceSize {
+		return nil, fmt.Errorf("nonce of challenge must be %d bytes", challengeNonceSize)
+	}
+	return c, nil
+}
+
+func ParseChallengeResponse(b []byte) (*ChallengeResponse, error) {
+	r := &ChallengeResponse{}
+	if err := json.Unmarshal(b, r); err != nil {
+		return nil, fmt.Errorf("malformed challenge response: %v", err)
+	}
+	if len(r.NonceResponse) == 0 {
+		return nil, errors.New("nonce_response must not be empty")
+	}
+	return r, nil
+}
+
+// SupportsEnvelopeFields reports whether the payload is a versioned envelope,
+// which may carry host facts, node id and the agent plugin version.
+func (d *AttestationData) SupportsEnvelopeFields() bool {
+	return d.Version >= AttestationDataVersion1
+}
+
+func ParseAttestationData(data []byte) (*AttestationData, error) {
+	d := &AttestationData{}
+	if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		d.Version = AttestationDataVersionLegacy
+		d.IDToken = string(data)
+		return d, nil
+	}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	if d.Version < AttestationDataVersionLegacy || d.Version > AttestationDataVersion {
+		return nil, fmt.Errorf("attestation data version %d is not supported, supported versions are up to %d", d.Version, AttestationDataVersion)
+	}
+	if d.IDToken == "" && d.AccessToken == "" {
+		return nil, errors.New("id_token or access_token must not be empty")
+	}
+	if !d.SupportsEnvelopeFields() {
+		d.Certificate = nil
+		d.HostFacts = nil
+		d.PluginVersion = ""
+		d.NodeID = ""
+	}
+	return d, nil
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"strings"
+)
+
+// AzureResource is the resource parsed from the xms_mirid claim of managed identity tokens, like
+// /subscriptions/<subscription>/resourcegroups/<resource group>/providers/Microsoft.Compute/virtualMachines/<vm name>
+type AzureResource struct {
+	Subscription  string
+	ResourceGroup string
+	VMName        string
+}
+
+func ParseAzureResourceID(id string) AzureResource {
+	r := AzureResource{}
+	segments := strings.Split(strings.Trim(id, "/"), "/")
+	for i := 0; i+1 < len(segments); i += 2 {
+		switch strings.ToLower(segments[i]) {
+		case "subscriptions":
+			r.Subscription = segments[i+1]
+		case "resourcegroups":
+			r.ResourceGroup = segments[i+1]
+		case "virtualmachines":
+			r.VMName = segments[i+1]
+		}
+	}
+	return r
+}
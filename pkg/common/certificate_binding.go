@@ -0,0 +1,64 @@
+package common
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// signed with the nonce, so that signatures of the key for other purposes can't be replayed as responses
+const certificateBindingContext = "oidc node attestor certificate binding\x00"
+
+// SignChallenge proves possession of the key of the certificate which the token is bound to.
+func SignChallenge(key crypto.Signer, c *Challenge) (*ChallengeResponse, error) {
+	var opts crypto.SignerOpts = crypto.SHA256
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		opts = &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+	case *ecdsa.PublicKey:
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key.Public())
+	}
+	sig, err := key.Sign(rand.Reader, challengeDigest(c), opts)
+	if err != nil {
+		return nil, err
+	}
+	return &ChallengeResponse{NonceResponse: sig}, nil
+}
+
+// VerifyChallengeResponse checks the response is signed by the key of the certificate.
+func VerifyChallengeResponse(cert *x509.Certificate, c *Challenge, r *ChallengeResponse) error {
+	digest := challengeDigest(c)
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		if err := rsa.VerifyPSS(pub, crypto.SHA256, digest, r.NonceResponse, opts); err != nil {
+			return errors.New("nonce_response is not signed by the key of the certificate")
+		}
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(r.NonceResponse, &sig); err != nil || len(rest) > 0 {
+			return errors.New("malformed nonce_response")
+		}
+		if !ecdsa.Verify(pub, digest, sig.R, sig.S) {
+			return errors.New("nonce_response is not signed by the key of the certificate")
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T", cert.PublicKey)
+	}
+	return nil
+}
+
+func challengeDigest(c *Challenge) []byte {
+	sum := sha256.Sum256(append([]byte(certificateBindingContext), c.Nonce...))
+	return sum[:]
+}
@@ -0,0 +1,102 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// EmailCanonicalization normalizes emails before selector and SPIFFE ID generation,
+// so that different spellings of the same mailbox identify the same agent.
+// The agent and server plugins must be configured with the same rules.
+type EmailCanonicalization struct {
+	// lowercases local part and domain
+	Lowercase bool `hcl:"lowercase"`
+	// strips "+tag" from local part
+	StripPlusTag bool `hcl:"strip_plus_tag"`
+	// maps alias domains to canonical ones, e.g. corp.example = example.com
+	DomainAliases map[string]string `hcl:"domain_aliases"`
+	// converts internationalized domains to punycode
+	Punycode bool `hcl:"punycode"`
+}
+
+func (e *EmailCanonicalization) Validate() (err error) {
+	aliases := map[string]bool{}
+	for from, to := range e.DomainAliases {
+		if from == "" || to == "" {
+			return errors.New("email_canonicalization.domain_aliases must not contain empty domains")
+		}
+		for _, domain := range []string{from, to} {
+			if _, _err := idna.Lookup.ToASCII(domain); _err != nil {
+				return fmt.Errorf("email_canonicalization.domain_aliases contains invalid domain %q: %v", domain, _err)
+			}
+		}
+		alias, _err := e.canonicalDomain(from)
+		if _err != nil {
+			return fmt.Errorf("email_canonicalization.domain_aliases is invalid: %v", _err)
+		}
+		aliases[alias] = true
+	}
+	// aliases are resolved once, so chained aliases would leave emails of the same mailbox different
+	for from, to := range e.DomainAliases {
+		canonical, _err := e.canonicalDomain(to)
+		if _err != nil {
+			return fmt.Errorf("email_canonicalization.domain_aliases is invalid: %v", _err)
+		}
+		if aliases[canonical] {
+			return fmt.Errorf("email_canonicalization.domain_aliases maps %s to %s, which is an alias itself", from, to)
+		}
+	}
+	return nil
+}
+
+// Canonicalize returns the canonical form of email.
+func (e *EmailCanonicalization) Canonicalize(email string) (string, error) {
+	i := strings.LastIndex(email, "@")
+	if i <= 0 || i == len(email)-1 {
+		return "", fmt.Errorf("malformed email %q", email)
+	}
+	local, domain := email[:i], email[i+1:]
+
+	if e.StripPlusTag {
+		if j := strings.Index(local, "+"); j > 0 {
+			local = local[:j]
+		}
+	}
+	if e.Lowercase {
+		local = strings.ToLower(local)
+	}
+	domain, err := e.canonicalDomain(domain)
+	if err != nil {
+		return "", err
+	}
+	for from, to := range e.DomainAliases {
+		alias, err := e.canonicalDomain(from)
+		if err != nil {
+			return "", err
+		}
+		if domain == alias {
+			if domain, err = e.canonicalDomain(to); err != nil {
+				return "", err
+			}
+			break
+		}
+	}
+	return local + "@" + domain, nil
+}
+
+func (e *EmailCanonicalization) canonicalDomain(domain string) (string, error) {
+	if e.Lowercase {
+		domain = strings.ToLower(domain)
+	}
+	if e.Punycode {
+		ascii, err := idna.Lookup.ToASCII(domain)
+		if err != nil {
+			return "", fmt.Errorf("failed to convert domain %q to punycode: %v", domain, err)
+		}
+		domain = ascii
+	}
+	return domain, nil
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+const minHMACKeyLength = 32
+
+// LoadHMACKey reads the secret key of hashed identifiers from the file.
+func LoadHMACKey(path string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key := bytes.TrimSpace(b)
+	if len(key) < minHMACKeyLength {
+		return nil, fmt.Errorf("%s must contain a key of at least %d bytes", path, minHMACKeyLength)
+	}
+	return key, nil
+}
+
+// HashIdentifier returns hex encoded HMAC-SHA256 of the parts,
+// which identifies the same user without disclosing the parts.
+func HashIdentifier(key []byte, parts ...string) string {
+	mac := hmac.New(sha256.New, key)
+	// parts are separated by NUL so that ("ab", "c") and ("a", "bc") don't collide
+	mac.Write([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,132 @@
+package common
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+const (
+	HostFactHostname      = "hostname"
+	HostFactMachineID     = "machine_id"
+	HostFactOS            = "os"
+	HostFactOSVersion     = "os_version"
+	HostFactKernelVersion = "kernel_version"
+	// comma separated mac addresses of interfaces which are up, excluding loopback
+	HostFactMACAddresses = "mac_addresses"
+)
+
+var hostFacts = []string{
+	HostFactHostname,
+	HostFactMachineID,
+	HostFactOS,
+	HostFactOSVersion,
+	HostFactKernelVersion,
+	HostFactMACAddresses,
+}
+
+var hostFactCollectors = map[string]func() (string, error){
+	HostFactHostname:      os.Hostname,
+	HostFactMachineID:     machineID,
+	HostFactOS:            func() (string, error) { return runtime.GOOS, nil },
+	HostFactOSVersion:     osVersion,
+	HostFactKernelVersion: kernelVersion,
+	HostFactMACAddresses:  macAddresses,
+}
+
+// HostFactsConfig enables host facts, which are collected by the agent plugin and emitted as selectors
+// by the server plugin. They are asserted by the agent, not verified by the issuer.
+type HostFactsConfig struct {
+	HostFacts []string `hcl:"host_facts"`
+}
+
+func (c HostFactsConfig) Validate() error {
+	for _, name := range c.HostFacts {
+		if _, ok := hostFactCollectors[name]; !ok {
+			return fmt.Errorf("host_facts must be some of %s", strings.Join(hostFacts, ","))
+		}
+	}
+	return nil
+}
+
+// CollectHostFacts collects the named facts of this host.
+// Facts which can't be collected on this host are skipped.
+func CollectHostFacts(names []string) map[string]string {
+	facts := map[string]string{}
+	for _, name := range names {
+		collect, ok := hostFactCollectors[name]
+		if !ok {
+			continue
+		}
+		v, err := collect()
+		if err != nil {
+			log.Printf("INFO: skipping host fact %s: %s", name, err)
+			continue
+		}
+		if v != "" {
+			facts[name] = v
+		}
+	}
+	return facts
+}
+
+func machineID() (string, error) {
+	b, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func osVersion() (string, error) {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	values := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		kv := strings.SplitN(s.Text(), "=", 2)
+		if len(kv) == 2 {
+			values[kv[0]] = strings.Trim(kv[1], `"'`)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+	if values["ID"] == "" {
+		return values["VERSION_ID"], nil
+	}
+	return strings.TrimSuffix(values["ID"]+" "+values["VERSION_ID"], " "), nil
+}
+
+func kernelVersion() (string, error) {
+	b, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func macAddresses() (string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	var macs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		macs = append(macs, iface.HardwareAddr.String())
+	}
+	sort.Strings(macs)
+	return strings.Join(macs, ","), nil
+}
@@ -5,49 +5,235 @@ import (
 	"github.com/everpeace/oidc_attestor_plugin/pkg"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/oidcutil"
 	"log"
-	"net/url"
 	"path"
 	"strings"
 )
 
 type IDGenMode struct {
 	Mode Mode `hcl:"mode"`
+	// secret key of hashed modes, the agent can preview the same IDs with the same key
+	HMACKeyFile string `hcl:"hmac_key_file"`
+	// rules applied to email claim before generating IDs and selectors of email modes
+	EmailCanonicalization *EmailCanonicalization `hcl:"email_canonicalization"`
+	// path prefix of SPIFFE IDs under spire/agent, defaults to spire/agent/oidc
+	PathPrefix string `hcl:"path_prefix"`
 }
 
 type Mode string
 var (
 	IDGenModeIssuerAndSubject Mode = "issuer_and_subject"
 	IDGenModeEmail            Mode = "email"
-	agentPathPrefix                = path.Join("spire", "agent", pkg.PluginName)
+	// spire/agent/oidc/github/<owner>/<repository>/<workflow>
+	IDGenModeGitHubRepositoryWorkflow Mode = "github_repository_workflow"
+	// spire/agent/oidc/gitlab/<namespace>/.../<project>
+	IDGenModeGitLabProject Mode = "gitlab_project"
+	// spire/agent/oidc/k8s/<issuer alias>/ns/<namespace>/sa/<service account>
+	IDGenModeKubernetesServiceAccount Mode = "kubernetes_service_account"
+	// spire/agent/oidc/gce/<project id>/<zone>/<instance id>
+	IDGenModeGCEInstance Mode = "gce_instance"
+	// spire/agent/oidc/azure/<tenant id>/<subscription>/<resource group>/<vm name>
+	IDGenModeAzureVM Mode = "azure_vm"
+	// spire/agent/oidc/<issuer alias>/<subject>/node/<node id>
+	IDGenModeIssuerSubjectAndNode Mode = "issuer_subject_and_node"
+	// spire/agent/oidc/<email>/node/<node id>
+	IDGenModeEmailAndNode Mode = "email_and_node"
+	// spire/agent/oidc/hashed/<hmac of issuer and subject>
+	IDGenModeHashedIssuerAndSubject Mode = "hashed_issuer_and_subject"
+	// spire/agent/oidc/hashed/<hmac of email>
+	IDGenModeHashedEmail Mode = "hashed_email"
+	DefaultPathPrefix                = path.Join("spire", "agent", pkg.PluginName)
+
+	modes = []Mode{
+		IDGenModeIssuerAndSubject,
+		IDGenModeEmail,
+		IDGenModeGitHubRepositoryWorkflow,
+		IDGenModeGitLabProject,
+		IDGenModeKubernetesServiceAccount,
+		IDGenModeGCEInstance,
+		IDGenModeAzureVM,
+		IDGenModeIssuerSubjectAndNode,
+		IDGenModeEmailAndNode,
+		IDGenModeHashedIssuerAndSubject,
+		IDGenModeHashedEmail,
+	}
 )
 
 func (m IDGenMode) Validate() (err error) {
-	if !(m.Mode == IDGenModeIssuerAndSubject || m.Mode == IDGenModeEmail) {
-		err = fmt.Errorf("mode must be one of %s",
-			strings.Join([]string{string(IDGenModeIssuerAndSubject), string(IDGenModeEmail)}, ","),
+	names := []string{}
+	for _, mode := range modes {
+		if m.Mode == mode {
+			if m.PathPrefix != "" {
+				if err := ValidatePathPrefix(m.PathPrefix); err != nil {
+					return err
+				}
+			}
+			if m.EmailCanonicalization != nil {
+				return m.EmailCanonicalization.Validate()
+			}
+			return nil
+		}
+		names = append(names, string(mode))
+	}
+	return fmt.Errorf("mode must be one of %s", strings.Join(names, ","))
+}
+
+// ValidateIssuerAlias checks the mode can generate valid SPIFFE IDs with the issuer alias,
+// since issuer urls and emails contain characters which SPIFFE IDs don't allow.
+func (m IDGenMode) ValidateIssuerAlias(issuerAlias string) error {
+	switch m.Mode {
+	case IDGenModeIssuerAndSubject, IDGenModeIssuerSubjectAndNode:
+		if issuerAlias == "" {
+			return fmt.Errorf("issuer_alias must not be empty for mode %s, issuer url can't be a path segment of SPIFFE IDs", m.Mode)
+		}
+	case IDGenModeEmail, IDGenModeEmailAndNode:
+		return fmt.Errorf("mode %s can't generate valid SPIFFE IDs since '@' of emails isn't allowed in them, use %s instead",
+			m.Mode, IDGenModeHashedEmail,
 		)
 	}
-	return
+	return nil
+}
+
+func (m IDGenMode) PathPrefixOrDefault() string {
+	if m.PathPrefix != "" {
+		return strings.Trim(m.PathPrefix, "/")
+	}
+	return DefaultPathPrefix
+}
+
+// CanonicalizeEmail replaces email claim with its canonical form when the mode generates IDs and selectors from it.
+// It must be called by both agent and server plugins, so that they generate the same IDs.
+func (m IDGenMode) CanonicalizeEmail(claims *oidcutil.Claims) error {
+	if m.EmailCanonicalization == nil || claims.Email == "" {
+		return nil
+	}
+	if !m.RequiresEmail() {
+		log.Printf("DEBUG: skipping email canonicalization, mode %s doesn't use email", m.Mode)
+		return nil
+	}
+	email, err := m.EmailCanonicalization.Canonicalize(claims.Email)
+	if err != nil {
+		return err
+	}
+	if email != claims.Email {
+		log.Printf("DEBUG: canonicalized email %s to %s", claims.Email, email)
+	}
+	claims.Email = email
+	return nil
+}
+
+// IsHashed reports whether the mode generates IDs from HMAC of the user's identifiers.
+func (m IDGenMode) IsHashed() bool {
+	return m.Mode == IDGenModeHashedIssuerAndSubject || m.Mode == IDGenModeHashedEmail
+}
+
+// IDInput is the input of SPIFFE ID generation.
+type IDInput struct {
+	TrustDomain string
+	IssuerAlias string
+	Claims      *oidcutil.Claims
+	// stable id of the agent's node, required by per node modes
+	NodeID string
+	// key loaded from hmac_key_file, required by hashed modes
+	HMACKey []byte
+}
+
+// RequiresEmail reports whether the mode identifies nodes by verified email.
+func (m IDGenMode) RequiresEmail() bool {
+	return m.Mode == IDGenModeEmail || m.Mode == IDGenModeEmailAndNode || m.Mode == IDGenModeHashedEmail
+}
+
+// RequiresNodeID reports whether the mode generates an ID per node.
+func (m IDGenMode) RequiresNodeID() bool {
+	return m.Mode == IDGenModeIssuerSubjectAndNode || m.Mode == IDGenModeEmailAndNode
 }
 
-func (m IDGenMode) GenerateSpiffeId(trustDomain string, claims *oidcutil.Claims) string {
-	var spiffePath string
+// GenerateSpiffeId returns the SPIFFE ID of the agent, or an error when claims would make an invalid ID.
+func (m IDGenMode) GenerateSpiffeId(in IDInput) (string, error) {
+	issuerAlias, claims := in.IssuerAlias, in.Claims
+	var segments []string
 	switch m.Mode {
 	case IDGenModeIssuerAndSubject:
-		spiffePath = path.Join(
-			agentPathPrefix, url.PathEscape(claims.Issuer), url.PathEscape(claims.Subject),
-		)
+		segments = append(issuerSegments(issuerAlias, claims), claims.Subject)
 	case IDGenModeEmail:
-		spiffePath = path.Join(
-			agentPathPrefix, url.PathEscape(claims.Email),
-		)
+		segments = append(tenantSegments(claims), claims.Email)
+	case IDGenModeIssuerSubjectAndNode:
+		segments = append(issuerSegments(issuerAlias, claims), claims.Subject, "node", in.NodeID)
+	case IDGenModeEmailAndNode:
+		segments = append(tenantSegments(claims), claims.Email, "node", in.NodeID)
+	case IDGenModeHashedIssuerAndSubject:
+		segments = []string{"hashed", HashIdentifier(in.HMACKey, claims.Issuer, claims.Subject)}
+	case IDGenModeHashedEmail:
+		hashed := HashIdentifier(in.HMACKey, claims.Email)
+		if claims.Tenant != "" {
+			hashed = HashIdentifier(in.HMACKey, claims.Tenant, claims.Email)
+		}
+		segments = []string{"hashed", hashed}
+	case IDGenModeGitHubRepositoryWorkflow:
+		repository, _ := claims.Get("repository")
+		workflow, _ := claims.Get("workflow")
+		segments = append(append([]string{"github"}, splitSegments(repository)...), workflow)
+	case IDGenModeGitLabProject:
+		projectPath, _ := claims.Get("project_path")
+		segments = append([]string{"gitlab"}, splitSegments(projectPath)...)
+	case IDGenModeKubernetesServiceAccount:
+		namespace, _ := claims.Get("kubernetes.io", "namespace")
+		serviceAccount, _ := claims.Get("kubernetes.io", "serviceaccount", "name")
+		segments = []string{"k8s", issuerAlias, "ns", namespace, "sa", serviceAccount}
+	case IDGenModeGCEInstance:
+		projectID, _ := claims.Get("google", "compute_engine", "project_id")
+		zone, _ := claims.Get("google", "compute_engine", "zone")
+		instanceID, _ := claims.Get("google", "compute_engine", "instance_id")
+		segments = []string{"gce", projectID, zone, instanceID}
+	case IDGenModeAzureVM:
+		tenantID, _ := claims.Get("tid")
+		resourceID, _ := claims.Get("xms_mirid")
+		r := ParseAzureResourceID(resourceID)
+		segments = []string{"azure", tenantID, r.Subscription, r.ResourceGroup, r.VMName}
 	}
+	// segments are not escaped, since SPIFFE IDs don't allow percent-encoding.
+	// claims which would need it are rejected instead
+	for _, seg := range segments {
+		if err := ValidatePathSegment(seg); err != nil {
+			return "", fmt.Errorf("%v, set issuer_alias or use hashed modes for claims which contain other characters", err)
+		}
+	}
+	spiffePath := joinPath(append([]string{m.PathPrefixOrDefault()}, segments...)...)
 	log.Printf("DEBUG: spiffePath=%s", spiffePath)
-	id := &url.URL{
-		Scheme: "spiffe",
-		Host:   trustDomain,
-		Path:   spiffePath,
+	id := "spiffe://" + in.TrustDomain + "/" + spiffePath
+	if err := ValidateSpiffeID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// issuerSegments returns the alias of the issuer when it is configured, otherwise the issuer url,
+// which is rejected as a path segment.
+// Tenant is added to the alias because an alias of multi-tenant issuer stands for all of its tenants.
+func issuerSegments(issuerAlias string, claims *oidcutil.Claims) []string {
+	if issuerAlias == "" {
+		return []string{claims.Issuer}
+	}
+	if claims.Tenant != "" {
+		return []string{issuerAlias, "tenant", claims.Tenant}
 	}
+	return []string{issuerAlias}
+}
+
+// tenantSegments returns "tenant", "<tenant>" for email modes of multi-tenant issuers,
+// since the same email can be a (guest) user of several tenants. Tenant is resolved from issuer_template
+// by both agent and server plugins, and it is empty for single-tenant issuers.
+func tenantSegments(claims *oidcutil.Claims) []string {
+	if claims.Tenant == "" {
+		return nil
+	}
+	return []string{"tenant", claims.Tenant}
+}
+
+func joinPath(segments ...string) string {
+	return strings.Join(segments, "/")
+}
 
-	return id.String()
+// splitSegments splits slash separated names like "group/project" into path segments.
+func splitSegments(s string) []string {
+	return strings.Split(s, "/")
 }
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	// random uuid generated on first run and persisted to instance_id_file
+	NodeIDSourceInstanceID = "instance_id"
+	// hash of /etc/machine-id, so that the machine id itself isn't disclosed
+	NodeIDSourceMachineID = "machine_id"
+
+	maxNodeIDLength = 64
+	// application specific salt of machine id hash, as recommended by machine-id(5)
+	machineIDHashSalt = "oidc-attestor-plugin/node-id:"
+)
+
+var nodeIDPattern = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// ValidateNodeID checks the node id sent by the agent is safe to be used as a path segment.
+func ValidateNodeID(nodeID string) error {
+	if nodeID == "" {
+		return fmt.Errorf("node id must not be empty")
+	}
+	if len(nodeID) > maxNodeIDLength || !nodeIDPattern.MatchString(nodeID) {
+		return fmt.Errorf("node id must be up to %d alphanumerics or hyphens: %q", maxNodeIDLength, nodeID)
+	}
+	return nil
+}
+
+// LoadNodeID returns the stable id of this node from the source.
+func LoadNodeID(source, instanceIDFile string) (string, error) {
+	switch source {
+	case NodeIDSourceInstanceID:
+		return loadOrCreateInstanceID(instanceIDFile)
+	case NodeIDSourceMachineID:
+		id, err := machineID()
+		if err != nil {
+			return "", err
+		}
+		if id == "" {
+			return "", fmt.Errorf("/etc/machine-id is empty")
+		}
+		sum := sha256.Sum256([]byte(machineIDHashSalt + id))
+		return hex.EncodeToString(sum[:16]), nil
+	}
+	return "", fmt.Errorf("unknown node id source %s", source)
+}
+
+func loadOrCreateInstanceID(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		id := strings.TrimSpace(string(b))
+		if err := ValidateNodeID(id); err != nil {
+			return "", fmt.Errorf("%s is corrupted: %v", path, err)
+		}
+		return id, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	id, err := newUUID()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// newUUID returns a random (version 4) uuid.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const maxSpiffeIDLength = 2048
+
+var (
+	trustDomainPattern = regexp.MustCompile(`^[a-z0-9._-]+$`)
+	// characters allowed in path segments by the SPIFFE ID specification, which forbids percent-encoding
+	pathSegmentPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+func ValidateTrustDomain(trustDomain string) error {
+	if !trustDomainPattern.MatchString(trustDomain) {
+		return fmt.Errorf("trust domain %q must consist of lowercase letters, digits, '.', '_' or '-'", trustDomain)
+	}
+	return nil
+}
+
+// agentPathPrefix is the path under which SPIRE server renews agent SVIDs
+const agentPathPrefix = "spire/agent/"
+
+// ValidatePathPrefix checks the prefix is "spire/agent/<segment>...",
+// since SPIRE server doesn't renew agent SVIDs outside of spire/agent.
+func ValidatePathPrefix(prefix string) error {
+	trimmed := strings.Trim(prefix, "/")
+	if !strings.HasPrefix(trimmed, agentPathPrefix) {
+		return fmt.Errorf("path_prefix %q must start with %s followed by at least one segment", prefix, agentPathPrefix)
+	}
+	for _, seg := range strings.Split(trimmed, "/") {
+		if seg == "." || seg == ".." || !pathSegmentPattern.MatchString(seg) {
+			return fmt.Errorf("path_prefix %q must consist of non dot segments of letters, digits, '.', '_' or '-'", prefix)
+		}
+	}
+	return nil
+}
+
+// ValidatePathSegment checks the segment is not empty nor a dot segment,
+// and consists of characters allowed by the SPIFFE ID specification.
+func ValidatePathSegment(seg string) error {
+	switch {
+	case seg == "":
+		return errors.New("SPIFFE ID must not contain empty path segments")
+	case seg == "." || seg == "..":
+		return fmt.Errorf("SPIFFE ID must not contain dot path segment %q", seg)
+	case !pathSegmentPattern.MatchString(seg):
+		return fmt.Errorf("SPIFFE ID path segment %q must consist of letters, digits, '.', '_' or '-'", seg)
+	}
+	return nil
+}
+
+// ValidateSpiffeID checks the id conforms to the SPIFFE ID specification:
+// spiffe scheme, valid trust domain, path segments of letters, digits, '.', '_' or '-' without dot segments,
+// and at most 2048 bytes.
+func ValidateSpiffeID(id string) error {
+	if len(id) > maxSpiffeIDLength {
+		return fmt.Errorf("SPIFFE ID must not be longer than %d bytes: %s", maxSpiffeIDLength, id)
+	}
+	rest := strings.TrimPrefix(id, "spiffe://")
+	if rest == id {
+		return fmt.Errorf("SPIFFE ID must start with spiffe://: %s", id)
+	}
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return fmt.Errorf("SPIFFE ID of agents must have a path: %s", id)
+	}
+	if err := ValidateTrustDomain(rest[:i]); err != nil {
+		return err
+	}
+	for _, seg := range strings.Split(rest[i+1:], "/") {
+		if err := ValidatePathSegment(seg); err != nil {
+			return fmt.Errorf("%v: %s", err, id)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/everpeace/oidc_attestor_plugin/pkg/oidcutil"
+)
+
+func TestValidateSpiffeID(t *testing.T) {
+	tests := []struct {
+		id    string
+		valid bool
+	}{
+		{"spiffe://example.org/spire/agent/oidc/google/123", true},
+		{"spiffe://example.org/spire/agent/oidc/a-b_c.d", true},
+		{"spiffe://example.org", false},
+		{"https://example.org/spire/agent/oidc", false},
+		{"spiffe://Example.org/spire/agent/oidc", false},
+		{"spiffe://example.org/spire//agent", false},
+		{"spiffe://example.org/spire/agent/", false},
+		{"spiffe://example.org/spire/agent/..", false},
+		{"spiffe://example.org/spire/agent/a%20b", false},
+		{"spiffe://example.org/spire/agent/a@example.com", false},
+		{"spiffe://example.org/spire/agent/a+b", false},
+		{"spiffe://example.org/spire/agent/https:", false},
+		{"spiffe://example.org/spire/agent/a?b", false},
+	}
+	for _, tt := range tests {
+		err := ValidateSpiffeID(tt.id)
+		if tt.valid && err != nil {
+			t.Errorf("ValidateSpiffeID(%q) = %v, want nil", tt.id, err)
+		}
+		if !tt.valid && err == nil {
+			t.Errorf("ValidateSpiffeID(%q) = nil, want error", tt.id)
+		}
+	}
+}
+
+func TestGenerateSpiffeId(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	google := &oidcutil.Claims{Issuer: "https://accounts.google.com", Subject: "1234567890"}
+	tests := []struct {
+		name  string
+		mode  IDGenMode
+		in    IDInput
+		want  string
+		valid bool
+	}{
+		{
+			name:  "issuer alias and subject",
+			mode:  IDGenMode{Mode: IDGenModeIssuerAndSubject},
+			in:    IDInput{TrustDomain: "example.org", IssuerAlias: "google", Claims: google},
+			want:  "spiffe://example.org/spire/agent/oidc/google/1234567890",
+			valid: true,
+		},
+		{
+			name: "issuer url is not a segment",
+			mode: IDGenMode{Mode: IDGenModeIssuerAndSubject},
+			in:   IDInput{TrustDomain: "example.org", Claims: google},
+		},
+		{
+			name: "subject which needs escaping",
+			mode: IDGenMode{Mode: IDGenModeIssuerAndSubject},
+			in: IDInput{TrustDomain: "example.org", IssuerAlias: "google",
+				Claims: &oidcutil.Claims{Issuer: "https://accounts.google.com", Subject: "a b"},
+			},
+		},
+		{
+			name: "subject with slash",
+			mode: IDGenMode{Mode: IDGenModeIssuerAndSubject},
+			in: IDInput{TrustDomain: "example.org", IssuerAlias: "google",
+				Claims: &oidcutil.Claims{Issuer: "https://accounts.google.com", Subject: "a/node/b"},
+			},
+		},
+		{
+			name: "tenant of multi-tenant issuer",
+			mode: IDGenMode{Mode: IDGenModeIssuerSubjectAndNode},
+			in: IDInput{TrustDomain: "example.org", IssuerAlias: "aad", NodeID: "node-1",
+				Claims: &oidcutil.Claims{Issuer: "https://login.microsoftonline.com/t1/v2.0", Subject: "s1", Tenant: "t1"},
+			},
+			want:  "spiffe://example.org/spire/agent/oidc/aad/tenant/t1/s1/node/node-1",
+			valid: true,
+		},
+		{
+			name: "email",
+			mode: IDGenMode{Mode: IDGenModeEmail},
+			in: IDInput{TrustDomain: "example.org",
+				Claims: &oidcutil.Claims{Issuer: "https://accounts.google.com", Email: "user@example.com"},
+			},
+		},
+		{
+			name: "hashed email",
+			mode: IDGenMode{Mode: IDGenModeHashedEmail},
+			in: IDInput{TrustDomain: "example.org", HMACKey: key,
+				Claims: &oidcutil.Claims{Issuer: "https://accounts.google.com", Email: "user@example.com"},
+			},
+			want:  "spiffe://example.org/spire/agent/oidc/hashed/" + HashIdentifier(key, "user@example.com"),
+			valid: true,
+		},
+		{
+			name:  "path prefix",
+			mode:  IDGenMode{Mode: IDGenModeIssuerAndSubject, PathPrefix: "/spire/agent/corp/"},
+			in:    IDInput{TrustDomain: "example.org", IssuerAlias: "google", Claims: google},
+			want:  "spiffe://example.org/spire/agent/corp/google/1234567890",
+			valid: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := tt.mode.GenerateSpiffeId(tt.in)
+		if !tt.valid {
+			if err == nil {
+				t.Errorf("%s: GenerateSpiffeId() = %q, want error", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: GenerateSpiffeId() = %v, want %q", tt.name, err, tt.want)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: GenerateSpiffeId() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -2,18 +2,288 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"github.com/hashicorp/go-multierror"
+	"strings"
+	"time"
+)
+
+const (
+	ClientAuthMethodClientSecretBasic = "client_secret_basic"
+	ClientAuthMethodPrivateKeyJWT     = "private_key_jwt"
+	ClientAuthMethodTLSClientAuth     = "tls_client_auth"
+
+	TokenSourceTokenFile     = "token_file"
+	TokenSourceExec          = "exec"
+	TokenSourceRefreshToken  = "refresh_token"
+	TokenSourceDeviceCode    = "device_code"
+	TokenSourceBrowser       = "browser"
+	TokenSourceGitHubActions = "github_actions"
+	TokenSourceGitLabCI      = "gitlab_ci"
+	TokenSourceKubernetes    = "kubernetes"
+	TokenSourceGCE           = "gce"
+	TokenSourceAzure         = "azure"
+
+	defaultGitLabIDTokenVariable = "SPIRE_ID_TOKEN"
+	defaultKubernetesTokenPath   = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	defaultGCEMetadataURL        = "http://metadata.google.internal"
+	defaultAzureIMDSURL          = "http://169.254.169.254"
+
+	defaultFetchTimeout     = 60 * time.Second
+	interactiveFetchTimeout = 15 * time.Minute
 )
 
 type Agent struct {
 	Common       `hcl:",squash"`
-	ClientSecret string    `hcl:"client_secret"`
+	ClientAuthMethod       string   `hcl:"client_auth_method"`
+	ClientSecret           string   `hcl:"client_secret"`
+	ClientSecretFile       string   `hcl:"client_secret_file"`
+	ClientSecretEnv        string   `hcl:"client_secret_env"`
+	ClientSecretCommand    []string `hcl:"client_secret_command"`
+	ClientAssertionKeyFile string   `hcl:"client_assertion_key_file"`
+	ClientAssertionKeyID   string   `hcl:"client_assertion_key_id"`
+	TLSClientCertFile      string   `hcl:"tls_client_cert_file"`
+	TLSClientKeyFile       string   `hcl:"tls_client_key_file"`
+
+	// token sources tried in this order, e.g. ["token_file", "refresh_token", "device_code", "browser"]
+	TokenSources []string `hcl:"token_sources"`
+	// reads pre-provisioned id token from the file
+	TokenFile string `hcl:"token_file"`
+	// runs the credential helper command to get id token
+	Exec *Exec `hcl:"exec"`
+	// CI/CD variable which holds the id token declared in id_tokens of .gitlab-ci.yml
+	GitLabIDTokenVariable string `hcl:"gitlab_id_token_variable"`
+	// projected service account token, defaults to the token of the pod's service account
+	KubernetesTokenPath string `hcl:"kubernetes_token_path"`
+	// base url of the GCE metadata server, can be changed for testing
+	GCEMetadataURL string `hcl:"gce_metadata_url"`
+	// base url of Azure Instance Metadata Service, can be changed for testing
+	AzureIMDSURL string `hcl:"azure_imds_url"`
+	// sends the access token along with the id token, e.g. for userinfo enrichment on the server
+	SendAccessToken bool `hcl:"send_access_token"`
+	// sends the raw id token instead of the versioned envelope, for servers running versions of the plugin
+	// which don't understand the envelope. features carried by the envelope can't be used with it
+	LegacyAttestationData bool `hcl:"legacy_attestation_data"`
+	// source of the stable node id used by per node modes, instance_id or machine_id
+	NodeIDSource string `hcl:"node_id_source"`
+	// file which persists the instance id generated on first run
+	InstanceIDFile string `hcl:"instance_id_file"`
+	// persists refresh token so that it can be used after agent restarts
+	RefreshTokenCacheFile string `hcl:"refresh_token_cache_file"`
+
+	// dynamic client registration (RFC 7591)
+	RegistrationInitialAccessToken string `hcl:"registration_initial_access_token"`
+	RegistrationStateFile          string `hcl:"registration_state_file"`
+	// software_id registered with the client, which the server accepts by allowed_software_ids
+	// when the issuer adds it to id tokens. defaults to spire-agent-oidc-node-attestor
+	RegistrationSoftwareID string `hcl:"registration_software_id"`
+}
+
+// FetchTimeout is the deadline of fetching attestation data. Interactive token sources
+// wait for the user to complete the login, which takes minutes.
+func (c *Agent) FetchTimeout() time.Duration {
+	for _, name := range c.TokenSourceNames() {
+		if name == TokenSourceDeviceCode || name == TokenSourceBrowser {
+			return interactiveFetchTimeout
+		}
+	}
+	return defaultFetchTimeout
+}
+
+// TokenSourceNames returns token_sources, or the single source implied by
+// token_file or exec for configurations written before token_sources existed.
+func (c *Agent) TokenSourceNames() []string {
+	switch {
+	case len(c.TokenSources) > 0:
+		return c.TokenSources
+	case c.TokenFile != "":
+		return []string{TokenSourceTokenFile}
+	case c.Exec != nil:
+		return []string{TokenSourceExec}
+	case c.Profile == ProfileGitHubActions:
+		return []string{TokenSourceGitHubActions}
+	case c.Profile == ProfileGitLabCI:
+		return []string{TokenSourceGitLabCI}
+	case c.Profile == ProfileKubernetes:
+		return []string{TokenSourceKubernetes}
+	case c.Profile == ProfileGCE:
+		return []string{TokenSourceGCE}
+	case c.Profile == ProfileAzure:
+		return []string{TokenSourceAzure}
+	default:
+		return []string{TokenSourceBrowser}
+	}
+}
+
+// IsOAuthClientTokenSource reports whether the token source needs the oauth2 client credentials.
+func IsOAuthClientTokenSource(name string) bool {
+	switch name {
+	case TokenSourceRefreshToken, TokenSourceDeviceCode, TokenSourceBrowser:
+		return true
+	}
+	return false
+}
+
+func (c *Agent) UsesOAuthClient() bool {
+	for _, name := range c.TokenSourceNames() {
+		if IsOAuthClientTokenSource(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Agent) GitLabIDTokenVariableName() string {
+	if c.GitLabIDTokenVariable != "" {
+		return c.GitLabIDTokenVariable
+	}
+	return defaultGitLabIDTokenVariable
+}
+
+func (c *Agent) KubernetesTokenPathName() string {
+	if c.KubernetesTokenPath != "" {
+		return c.KubernetesTokenPath
+	}
+	return defaultKubernetesTokenPath
+}
+
+func (c *Agent) GCEMetadataURLOrDefault() string {
+	if c.GCEMetadataURL != "" {
+		return c.GCEMetadataURL
+	}
+	return defaultGCEMetadataURL
+}
+
+func (c *Agent) AzureIMDSURLOrDefault() string {
+	if c.AzureIMDSURL != "" {
+		return c.AzureIMDSURL
+	}
+	return defaultAzureIMDSURL
+}
+
+func (c *Agent) DynamicRegistrationEnabled() bool {
+	return c.RegistrationInitialAccessToken != ""
 }
 
 func (c *Agent) Validate() (err error) {
 	err = c.Common.Validate()
-	if c.ClientSecret == "" {
-		err = multierror.Append(err, errors.New("client_secret must not be empty"))
+	for _, name := range c.TokenSourceNames() {
+		if _err := c.validateTokenSource(name); _err != nil {
+			err = multierror.Append(err, _err)
+		}
+		if c.UsesAccessToken() && !IsOAuthClientTokenSource(name) {
+			err = multierror.Append(err, fmt.Errorf("token source %s can't be used when token_type is access_token", name))
+		}
+		if c.SendAccessToken && !IsOAuthClientTokenSource(name) {
+			err = multierror.Append(err, fmt.Errorf("token source %s can't be used when send_access_token is set", name))
+		}
+	}
+	if c.LegacyAttestationData && (c.UsesAccessToken() || c.SendAccessToken || c.ClientAuthMethod == ClientAuthMethodTLSClientAuth) {
+		err = multierror.Append(err, errors.New(
+			"legacy_attestation_data can't be used with access_token, send_access_token or tls_client_auth",
+		))
+	}
+	if !c.UsesOAuthClient() {
+		if c.ExpectedAudience() == "" {
+			err = multierror.Append(err, errors.New("client_id or audience must not be empty"))
+		}
+		return
+	}
+	if c.DynamicRegistrationEnabled() {
+		if _err := c.validateDynamicRegistration(); _err != nil {
+			err = multierror.Append(err, _err)
+		}
+		return
+	}
+	if c.ClientID == "" {
+		err = multierror.Append(err, errors.New("client_id must not be empty"))
+	}
+	switch c.ClientAuthMethod {
+	case "", ClientAuthMethodClientSecretBasic:
+		if _err := c.validateClientSecret(); _err != nil {
+			err = multierror.Append(err, _err)
+		}
+	case ClientAuthMethodPrivateKeyJWT:
+		if c.ClientAssertionKeyFile == "" {
+			err = multierror.Append(err, errors.New("client_assertion_key_file must not be empty"))
+		}
+	case ClientAuthMethodTLSClientAuth:
+		if c.TLSClientCertFile == "" {
+			err = multierror.Append(err, errors.New("tls_client_cert_file must not be empty"))
+		}
+		if c.TLSClientKeyFile == "" {
+			err = multierror.Append(err, errors.New("tls_client_key_file must not be empty"))
+		}
+	default:
+		err = multierror.Append(err, fmt.Errorf("client_auth_method must be one of %s",
+			strings.Join([]string{
+				ClientAuthMethodClientSecretBasic, ClientAuthMethodPrivateKeyJWT, ClientAuthMethodTLSClientAuth,
+			}, ","),
+		))
+	}
+	return
+}
+
+func (c *Agent) validateTokenSource(name string) (err error) {
+	switch name {
+	case TokenSourceTokenFile:
+		if c.TokenFile == "" {
+			err = errors.New("token_file must not be empty")
+		}
+	case TokenSourceExec:
+		if c.Exec == nil {
+			err = errors.New("exec must be set")
+		} else {
+			err = c.Exec.Validate()
+		}
+	case TokenSourceRefreshToken:
+		if c.RefreshTokenCacheFile == "" {
+			err = errors.New("refresh_token_cache_file must not be empty")
+		}
+	case TokenSourceDeviceCode, TokenSourceBrowser, TokenSourceGitHubActions, TokenSourceGitLabCI,
+		TokenSourceKubernetes, TokenSourceGCE, TokenSourceAzure:
+	default:
+		err = fmt.Errorf("token_sources must be some of %s",
+			strings.Join([]string{
+				TokenSourceTokenFile, TokenSourceExec, TokenSourceRefreshToken, TokenSourceDeviceCode, TokenSourceBrowser,
+				TokenSourceGitHubActions, TokenSourceGitLabCI, TokenSourceKubernetes, TokenSourceGCE, TokenSourceAzure,
+			}, ","),
+		)
+	}
+	return
+}
+
+func (c *Agent) validateClientSecret() error {
+	n := 0
+	for _, set := range []bool{
+		c.ClientSecret != "",
+		c.ClientSecretFile != "",
+		c.ClientSecretEnv != "",
+		len(c.ClientSecretCommand) > 0,
+	} {
+		if set {
+			n++
+		}
+	}
+	if n != 1 {
+		return errors.New(
+			"exactly one of client_secret, client_secret_file, client_secret_env, client_secret_command must be set",
+		)
+	}
+	return nil
+}
+
+func (c *Agent) validateDynamicRegistration() (err error) {
+	if c.RegistrationStateFile == "" {
+		err = multierror.Append(err, errors.New("registration_state_file must not be empty"))
+	}
+	if c.ClientID != "" {
+		err = multierror.Append(err, errors.New("client_id must be empty when dynamic client registration is enabled"))
+	}
+	if !(c.ClientAuthMethod == "" || c.ClientAuthMethod == ClientAuthMethodClientSecretBasic) {
+		err = multierror.Append(err, fmt.Errorf(
+			"client_auth_method must be %s when dynamic client registration is enabled", ClientAuthMethodClientSecretBasic,
+		))
 	}
 	return
 }
@@ -2,24 +2,130 @@ package config
 
 import (
 	"errors"
+	"fmt"
+	"github.com/everpeace/oidc_attestor_plugin/pkg"
 	"github.com/hashicorp/go-multierror"
+	"regexp"
+	"strings"
 )
 
+const (
+	ProfileOIDC          = "oidc"
+	ProfileGitHubActions = "github_actions"
+	ProfileGitLabCI      = "gitlab_ci"
+	ProfileKubernetes    = "kubernetes"
+	ProfileGCE           = "gce"
+	ProfileAzure         = "azure"
+
+	GitHubActionsIssuerURL = "https://token.actions.githubusercontent.com"
+	GitLabIssuerURL        = "https://gitlab.com"
+	GoogleIssuerURL        = "https://accounts.google.com"
+
+	TokenTypeIDToken     = "id_token"
+	TokenTypeAccessToken = "access_token"
+)
+
+var issuerAliasPattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var profileIssuerURLs = map[string]string{
+	ProfileGitHubActions: GitHubActionsIssuerURL,
+	ProfileGitLabCI:      GitLabIssuerURL,
+	ProfileGCE:           GoogleIssuerURL,
+}
+
 type Common struct{
 	TrustDomain   string
+	Profile       string `hcl:"profile"`
 	IssuerURL     string `hcl:"issuer_url"`
 	ClientID      string `hcl:"client_id"`
+	// expected audience of tokens, defaults to client_id
+	Audience      string `hcl:"audience"`
+	// static JWKS used instead of keys discovered from issuer_url
+	JWKSFile      string `hcl:"jwks_file"`
+	// tenant of azure profile, issuer_url defaults to https://sts.windows.net/<tenant id>/
+	AzureTenantID string `hcl:"azure_tenant_id"`
+	// short name of the issuer used in SPIFFE IDs and issuer selectors instead of issuer url,
+	// e.g. cluster name for kubernetes profile
+	IssuerAlias   string `hcl:"issuer_alias"`
+	// kind of token used for attestation, id_token or access_token (RFC 9068 JWT)
+	TokenType     string `hcl:"token_type"`
+	// resource indicator (RFC 8707) of access tokens, which is their expected audience
+	Resource      string `hcl:"resource"`
+	// multi-tenant issuer containing {tenantid}, e.g. https://login.microsoftonline.com/{tenantid}/v2.0.
+	// the agent resolves the tenant of its tokens with it, so that it previews the same IDs as the server
+	IssuerTemplate string `hcl:"issuer_template"`
+	// name of the plugin in SPIRE configuration, defaults to oidc. the agent sends it as the type of attestation data,
+	// which SPIRE server uses to route attestation to the server plugin of the same name
+	PluginName string `hcl:"plugin_name"`
+}
+
+// SetDefaults fills the issuer url of the profile when it is not configured.
+func (c *Common) SetDefaults() {
+	if c.Profile == "" {
+		c.Profile = ProfileOIDC
+	}
+	if c.PluginName == "" {
+		c.PluginName = pkg.PluginName
+	}
+	if c.TokenType == "" {
+		c.TokenType = TokenTypeIDToken
+	}
+	if c.IssuerURL == "" {
+		c.IssuerURL = profileIssuerURLs[c.Profile]
+	}
+	if c.IssuerURL == "" && c.Profile == ProfileAzure && c.AzureTenantID != "" {
+		c.IssuerURL = fmt.Sprintf("https://sts.windows.net/%s/", c.AzureTenantID)
+	}
+}
+
+func (c *Common) ExpectedAudience() string {
+	if c.Audience != "" {
+		return c.Audience
+	}
+	return c.ClientID
+}
+
+func (c *Common) UsesAccessToken() bool {
+	return c.TokenType == TokenTypeAccessToken
 }
 
 func (c *Common) Validate() (err error) {
 	if c.TrustDomain == "" {
 		err = multierror.Append(err, errors.New("trust_domain must not be empty"))
 	}
+	switch c.Profile {
+	case "", ProfileOIDC, ProfileGitHubActions, ProfileGitLabCI, ProfileGCE, ProfileAzure:
+	case ProfileKubernetes:
+		if c.IssuerAlias == "" {
+			err = multierror.Append(err, errors.New("issuer_alias must not be empty for kubernetes profile"))
+		}
+	default:
+		err = multierror.Append(err, fmt.Errorf("profile must be one of %s",
+			strings.Join([]string{
+				ProfileOIDC, ProfileGitHubActions, ProfileGitLabCI, ProfileKubernetes, ProfileGCE, ProfileAzure,
+			}, ","),
+		))
+	}
 	if c.IssuerURL == "" {
 		err = multierror.Append(err, errors.New("issuer_id must not be empty"))
 	}
-	if c.ClientID == "" {
-		err = multierror.Append(err, errors.New("client_id must not be empty"))
+	// join_token is handled by SPIRE server itself
+	if c.PluginName == "join_token" {
+		err = multierror.Append(err, errors.New("plugin_name must not be join_token"))
+	}
+	if c.IssuerAlias != "" && (!issuerAliasPattern.MatchString(c.IssuerAlias) || c.IssuerAlias == "." || c.IssuerAlias == "..") {
+		err = multierror.Append(err, errors.New("issuer_alias must consist of alphanumerics, '.', '_' or '-'"))
+	}
+	switch c.TokenType {
+	case "", TokenTypeIDToken:
+	case TokenTypeAccessToken:
+		if c.Resource == "" {
+			err = multierror.Append(err, errors.New("resource must not be empty when token_type is access_token"))
+		}
+	default:
+		err = multierror.Append(err, fmt.Errorf("token_type must be one of %s",
+			strings.Join([]string{TokenTypeIDToken, TokenTypeAccessToken}, ","),
+		))
 	}
 	return
 }
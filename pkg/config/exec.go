@@ -0,0 +1,35 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"time"
+)
+
+const defaultExecTimeout = 30 * time.Second
+
+// Exec is a credential helper command which prints id token in json to stdout.
+type Exec struct {
+	Command string            `hcl:"command"`
+	Args    []string          `hcl:"args"`
+	Env     map[string]string `hcl:"env"`
+	Timeout string            `hcl:"timeout"`
+}
+
+func (e *Exec) Validate() (err error) {
+	if e.Command == "" {
+		err = multierror.Append(err, errors.New("exec.command must not be empty"))
+	}
+	if _, _err := e.TimeoutDuration(); _err != nil {
+		err = multierror.Append(err, fmt.Errorf("exec.timeout is invalid: %v", _err))
+	}
+	return
+}
+
+func (e *Exec) TimeoutDuration() (time.Duration, error) {
+	if e.Timeout == "" {
+		return defaultExecTimeout, nil
+	}
+	return time.ParseDuration(e.Timeout)
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"time"
+)
+
+const defaultIntrospectionCacheTTL = 30 * time.Second
+
+// Introspection configures verification of opaque access tokens by token introspection (RFC 7662).
+type Introspection struct {
+	// defaults to introspection_endpoint in the discovery document of the issuer
+	Endpoint         string `hcl:"endpoint"`
+	ClientID         string `hcl:"client_id"`
+	ClientSecret     string `hcl:"client_secret"`
+	ClientSecretFile string `hcl:"client_secret_file"`
+	// introspection results are reused for this duration, "0s" disables caching
+	CacheTTL string `hcl:"cache_ttl"`
+	// custom fields of introspection responses emitted as selectors
+	SelectorClaims []string `hcl:"selector_claims"`
+}
+
+func (i *Introspection) Validate() (err error) {
+	if i.ClientID == "" {
+		err = multierror.Append(err, errors.New("introspection.client_id must not be empty"))
+	}
+	if (i.ClientSecret == "") == (i.ClientSecretFile == "") {
+		err = multierror.Append(err, errors.New("exactly one of introspection.client_secret or introspection.client_secret_file must be set"))
+	}
+	if _, _err := i.CacheTTLDuration(); _err != nil {
+		err = multierror.Append(err, fmt.Errorf("introspection.cache_ttl is invalid: %v", _err))
+	}
+	return
+}
+
+func (i *Introspection) CacheTTLDuration() (time.Duration, error) {
+	if i.CacheTTL == "" {
+		return defaultIntrospectionCacheTTL, nil
+	}
+	return time.ParseDuration(i.CacheTTL)
+}
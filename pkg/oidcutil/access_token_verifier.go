@@ -0,0 +1,71 @@
+package oidcutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/coreos/go-oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// AccessTokenVerifier verifies JWT access tokens (RFC 9068).
+// Claims are mapped to Claims the same way as id tokens.
+type AccessTokenVerifier struct {
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewAccessTokenVerifier returns a verifier of access tokens.
+// verifier must be configured with the resource as its client id, so that the audience is checked against it.
+func NewAccessTokenVerifier(verifier *oidc.IDTokenVerifier) *AccessTokenVerifier {
+	return &AccessTokenVerifier{verifier: verifier}
+}
+
+func (v *AccessTokenVerifier) Verify(ctx context.Context, rawAccessToken string) (*TokenWrapper, error) {
+	if err := checkAccessTokenType(rawAccessToken); err != nil {
+		log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+	// go-oidc verifies signature, iss, aud and exp, which are common to id tokens and access tokens
+	token, err := v.verifier.Verify(ctx, rawAccessToken)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+	claims, err := NewClaims(token)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+	if claims.ClientID == "" {
+		err = errors.New("client_id claim must not be empty")
+		log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+	log.Printf("DEBUG: verified access token successfuly: claims=%+v", claims)
+
+	return &TokenWrapper{
+		IDToken:     token,
+		Claims:      claims,
+		AccessToken: rawAccessToken,
+	}, nil
+}
+
+// checkAccessTokenType checks typ header is at+jwt, so that id tokens can't be used as access tokens.
+func checkAccessTokenType(rawAccessToken string) error {
+	jws, err := jose.ParseSigned(rawAccessToken)
+	if err != nil {
+		return fmt.Errorf("malformed jwt: %v", err)
+	}
+	if len(jws.Signatures) == 0 {
+		return errors.New("access token is not signed")
+	}
+	typ, _ := jws.Signatures[0].Protected.ExtraHeaders[jose.HeaderType].(string)
+	switch strings.ToLower(typ) {
+	case "at+jwt", "application/at+jwt":
+		return nil
+	}
+	return fmt.Errorf("typ header of access token must be at+jwt: %q", typ)
+}
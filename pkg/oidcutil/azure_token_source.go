@@ -0,0 +1,68 @@
+package oidcutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const azureIMDSTokenPath = "/metadata/identity/oauth2/token"
+
+// AzureTokenSource obtains a token of the VM's managed identity from Azure Instance Metadata Service.
+type AzureTokenSource struct {
+	imdsURL  string
+	resource string
+	verifier *Verifier
+}
+
+func NewAzureTokenSource(verifier *Verifier, imdsURL, resource string) *AzureTokenSource {
+	return &AzureTokenSource{
+		imdsURL:  strings.TrimSuffix(imdsURL, "/"),
+		resource: resource,
+		verifier: verifier,
+	}
+}
+
+func (s *AzureTokenSource) Name() string {
+	return "azure"
+}
+
+func (s *AzureTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	q := url.Values{}
+	q.Set("api-version", "2018-02-01")
+	q.Set("resource", s.resource)
+	req, err := http.NewRequest(http.MethodGet, s.imdsURL+azureIMDSTokenPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, b)
+	}
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, err
+	}
+	if body.AccessToken == "" {
+		return nil, errors.New("response doesn't contain access_token")
+	}
+	return s.verifier.Verify(ctx, body.AccessToken)
+}
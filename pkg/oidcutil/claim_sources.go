@@ -0,0 +1,259 @@
+package oidcutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+)
+
+// claimSource is an entry of _claim_sources (OpenID Connect Core 5.6.2).
+// Aggregated claims carry JWT, distributed claims carry endpoint and optionally access_token.
+type claimSource struct {
+	JWT         string `json:"JWT"`
+	Endpoint    string `json:"endpoint"`
+	AccessToken string `json:"access_token"`
+}
+
+// ClaimSourceResolver resolves aggregated and distributed claims into Claims.
+type ClaimSourceResolver struct {
+	httpClient *http.Client
+	// issuers of aggregated claims JWTs trusted in addition to the issuer of the token
+	allowedIssuers map[string]bool
+
+	mtx       sync.Mutex
+	verifiers map[string]*oidc.IDTokenVerifier
+}
+
+func NewClaimSourceResolver(allowedIssuers []string) *ClaimSourceResolver {
+	allowed := map[string]bool{}
+	for _, issuer := range allowedIssuers {
+		allowed[issuer] = true
+	}
+	return &ClaimSourceResolver{
+		httpClient:     http.DefaultClient,
+		allowedIssuers: allowed,
+		verifiers:      map[string]*oidc.IDTokenVerifier{},
+	}
+}
+
+// Resolve fetches claims referenced by _claim_names, and merges them into claims.
+// Distributed claims endpoints are called with their own access token,
+// or with accessToken sent by the agent when the source doesn't have one.
+// Claim sources which can't be resolved are logged and skipped.
+func (r *ClaimSourceResolver) Resolve(ctx context.Context, claims *Claims, accessToken string) {
+	var refs struct {
+		ClaimNames   map[string]string       `json:"_claim_names"`
+		ClaimSources map[string]*claimSource `json:"_claim_sources"`
+	}
+	b, err := json.Marshal(claims.Raw)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return
+	}
+	if err := json.Unmarshal(b, &refs); err != nil {
+		log.Printf("ERROR: skipping claim sources: malformed _claim_names or _claim_sources: %s", err)
+		return
+	}
+
+	names := map[string][]string{}
+	for name, sourceName := range refs.ClaimNames {
+		names[sourceName] = append(names[sourceName], name)
+	}
+	for sourceName, sourceClaims := range names {
+		source, ok := refs.ClaimSources[sourceName]
+		if !ok {
+			log.Printf("ERROR: skipping claim source %s: it is not found in _claim_sources", sourceName)
+			continue
+		}
+		values, err := r.fetch(ctx, claims, source, sourceClaims, accessToken)
+		if err != nil {
+			log.Printf("ERROR: skipping claim source %s: %s", sourceName, err)
+			continue
+		}
+		for _, name := range sourceClaims {
+			v, ok := values[name]
+			if !ok {
+				log.Printf("ERROR: skipping claim %s: claim source %s doesn't contain it", name, sourceName)
+				continue
+			}
+			log.Printf("DEBUG: resolved claim %s from claim source %s", name, sourceName)
+			claims.Raw[name] = v
+		}
+	}
+}
+
+// fetch returns claims of the source. Responses of endpoints must be about the subject of claims,
+// because the access token sent by the agent isn't bound to the token and can be of another principal.
+func (r *ClaimSourceResolver) fetch(ctx context.Context, claims *Claims, source *claimSource, names []string, accessToken string) (map[string]interface{}, error) {
+	switch {
+	case source.JWT != "":
+		return r.verifyJWT(ctx, claims.Issuer, source.JWT)
+	case source.Endpoint != "":
+		if source.AccessToken != "" {
+			accessToken = source.AccessToken
+		}
+		if accessToken == "" {
+			return nil, errors.New("access token is required to call distributed claims endpoint")
+		}
+		if isGraphMemberObjectsEndpoint(source.Endpoint) {
+			// getMemberObjects responds without sub, the endpoint must be the one of the user
+			oid, _ := claims.Get("oid")
+			if !isGraphUserEndpoint(source.Endpoint, oid) {
+				return nil, fmt.Errorf("endpoint %s is not the one of user %q", source.Endpoint, oid)
+			}
+			return r.fetchGraphMemberObjects(ctx, source.Endpoint, names, accessToken)
+		}
+		values, err := r.fetchEndpoint(ctx, claims.Issuer, source.Endpoint, accessToken)
+		if err != nil {
+			return nil, err
+		}
+		if sub, _ := values["sub"].(string); sub != claims.Subject {
+			return nil, fmt.Errorf("sub %q of the response doesn't match sub %q of the token", sub, claims.Subject)
+		}
+		return values, nil
+	}
+	return nil, errors.New("claim source must have JWT or endpoint")
+}
+
+func (r *ClaimSourceResolver) fetchEndpoint(ctx context.Context, tokenIssuer, endpoint, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.do(ctx, req, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	// endpoints respond with either a signed JWT or plain json claims
+	body := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(body, "{") {
+		return r.verifyJWT(ctx, tokenIssuer, body)
+	}
+	values := map[string]interface{}{}
+	if err := json.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// isGraphMemberObjectsEndpoint reports whether the endpoint is the getMemberObjects action of Azure AD Graph,
+// which Azure AD refers for groups of users in too many groups.
+func isGraphMemberObjectsEndpoint(endpoint string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return false
+	}
+	return strings.HasSuffix(strings.ToLower(u.Path), "/getmemberobjects")
+}
+
+// isGraphUserEndpoint reports whether the endpoint is under users/<oid>, which is how Azure AD refers the user's groups.
+func isGraphUserEndpoint(endpoint, oid string) bool {
+	u, err := url.Parse(endpoint)
+	if err != nil || oid == "" {
+		return false
+	}
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(segments); i++ {
+		if strings.EqualFold(segments[i], "users") {
+			return strings.EqualFold(segments[i+1], oid)
+		}
+	}
+	return false
+}
+
+// fetchGraphMemberObjects calls getMemberObjects action, which is a POST returning {"value":[...]},
+// and returns the object ids as the value of the claims referring the source.
+func (r *ClaimSourceResolver) fetchGraphMemberObjects(ctx context.Context, endpoint string, names []string, accessToken string) (map[string]interface{}, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(`{"securityEnabledOnly":false}`))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	b, err := r.do(ctx, req, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	var resp struct {
+		Value []interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("malformed getMemberObjects response: %v", err)
+	}
+	values := map[string]interface{}{}
+	for _, name := range names {
+		values[name] = resp.Value
+	}
+	return values, nil
+}
+
+func (r *ClaimSourceResolver) do(ctx context.Context, req *http.Request, accessToken string) ([]byte, error) {
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := r.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, b)
+	}
+	return b, nil
+}
+
+// verifyJWT verifies the claims JWT with keys discovered from its issuer.
+// The issuer must be the issuer of the token or one of allowed issuers, which is checked before discovery
+// so that claims JWTs can't make the server fetch keys from arbitrary urls.
+func (r *ClaimSourceResolver) verifyJWT(ctx context.Context, tokenIssuer, raw string) (map[string]interface{}, error) {
+	issuer, err := unverifiedIssuer(raw)
+	if err != nil {
+		return nil, err
+	}
+	if issuer != tokenIssuer && !r.allowedIssuers[issuer] {
+		return nil, fmt.Errorf("issuer %s of claims jwt is not allowed", issuer)
+	}
+	verifier, err := r.verifier(issuer)
+	if err != nil {
+		return nil, err
+	}
+	token, err := verifier.Verify(ctx, raw)
+	if err != nil {
+		return nil, err
+	}
+	// exp is optional in claims JWTs
+	if !token.Expiry.IsZero() && time.Now().After(token.Expiry) {
+		return nil, errors.New("claims jwt is expired")
+	}
+	values := map[string]interface{}{}
+	if err := token.Claims(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func (r *ClaimSourceResolver) verifier(issuer string) (*oidc.IDTokenVerifier, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if v, ok := r.verifiers[issuer]; ok {
+		return v, nil
+	}
+	provider, err := oidc.NewProvider(context.Background(), issuer)
+	if err != nil {
+		return nil, err
+	}
+	v := provider.Verifier(&oidc.Config{SkipClientIDCheck: true, SkipExpiryCheck: true})
+	r.verifiers[issuer] = v
+	return v, nil
+}
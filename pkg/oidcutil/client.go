@@ -2,33 +2,38 @@ package oidcutil
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/phayes/freeport"
 	"github.com/skratchdot/open-golang/open"
 )
 
-var randSource *rand.Rand
-var alphabet = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
+const authRequestTTL = 10 * time.Minute
 
-func init(){
-	randSource = rand.New(rand.NewSource(time.Now().UnixNano()))
+func newRandomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-func newState() string{
-	b := make([]rune, 64)
-	for i := range b {
-		b[i] = alphabet[randSource.Intn(len(alphabet))]
-	}
-	return string(b)
+// authRequest is an outstanding authorization request started by the browser flow.
+type authRequest struct {
+	nonce  string
+	expiry time.Time
 }
 
 type Client struct {
@@ -38,15 +43,29 @@ type Client struct {
 
 	server *http.Server
 	oauth2Config *oauth2.Config
-	state string
+	httpClient *http.Client
+	auth ClientAuth
+
+	authReqMtx *sync.Mutex
+	authReqs   map[string]*authRequest
 
 	idTokenSource *IDTokenSource
 	callbackWaitCh chan struct{}
 
+	deviceAuthURL  string
+	tokenCacheFile string
+	resource       string
+
 	sigCh chan os.Signal
 }
 
-func NewClient(issuerURL, clientID, clientSecret string, verifiedEmailClaimCheck bool) (*Client, error) {
+func callbackURL(port int) string {
+	return fmt.Sprintf("http://localhost:%d/callback", port)
+}
+
+// NewClient creates a client for authentication with authorization code or device code flow.
+// The callback server listens on callbackPort, or on a free port when it is 0.
+func NewClient(issuerURL, clientID string, auth ClientAuth, callbackPort int, verifiedEmailClaimCheck bool) (*Client, error) {
 	log.Print("DEBUG: start oidcutil.NewClient")
 	provider, err := oidc.NewProvider(context.Background(), issuerURL)
 
@@ -58,20 +77,58 @@ func NewClient(issuerURL, clientID, clientSecret string, verifiedEmailClaimCheck
 
 	log.Print("DEBUG: finished oidc provider/initialization")
 
-	port, err := freeport.GetFreePort()
-	if err != nil {
-		log.Fatal(err)
-		return nil, err
+	port := callbackPort
+	if port == 0 {
+		port, err = freeport.GetFreePort()
+		if err != nil {
+			return nil, err
+		}
 	}
 	listen := fmt.Sprintf("localhost:%d", port)
-	log.Printf("INFO: Client is listening %s", listen)
 	mux := http.NewServeMux()
 	srv := &http.Server{Addr: listen, Handler: mux}
+	endpoint := provider.Endpoint()
+	// client credentials are added by clientAuthTransport, not by oauth2 package.
+	endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	var base http.RoundTripper = http.DefaultTransport
+	var metadata struct {
+		DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+		MTLSEndpointAliases         struct {
+			TokenEndpoint               string `json:"token_endpoint"`
+			DeviceAuthorizationEndpoint string `json:"device_authorization_endpoint"`
+		} `json:"mtls_endpoint_aliases"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, err
+	}
+	deviceAuthURL := metadata.DeviceAuthorizationEndpoint
+	if tlsAuth, ok := auth.(*tlsClientAuth); ok {
+		base = &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{tlsAuth.cert}},
+		}
+		if alias := metadata.MTLSEndpointAliases.TokenEndpoint; alias != "" {
+			log.Printf("INFO: using mtls endpoint alias for token endpoint: %s", alias)
+			endpoint.TokenURL = alias
+		}
+		if alias := metadata.MTLSEndpointAliases.DeviceAuthorizationEndpoint; alias != "" {
+			deviceAuthURL = alias
+		}
+	}
+	transport := &clientAuthTransport{
+		base:     base,
+		auth:     auth,
+		clientID: clientID,
+		tokenURL: endpoint.TokenURL,
+	}
+	if deviceAuthURL != "" {
+		transport.extraURLs = append(transport.extraURLs, deviceAuthURL)
+	}
+	httpClient := &http.Client{Transport: transport}
 	oauth2Config := &oauth2.Config{
 		ClientID:     clientID,
-		ClientSecret: clientSecret,
-		RedirectURL:  fmt.Sprintf("http://localhost:%d/callback", port),
-		Endpoint:     provider.Endpoint(),
+		RedirectURL:  callbackURL(port),
+		Endpoint:     endpoint,
 		Scopes:       []string{
 			oidc.ScopeOpenID,
 			oidc.ScopeOfflineAccess,
@@ -84,12 +141,23 @@ func NewClient(issuerURL, clientID, clientSecret string, verifiedEmailClaimCheck
 		verifiedEmailClaimCheck:  verifiedEmailClaimCheck,
 		server: srv,
 		oauth2Config:   oauth2Config,
+		httpClient:     httpClient,
+		auth:           auth,
+		authReqMtx:     &sync.Mutex{},
+		authReqs:       map[string]*authRequest{},
 		callbackWaitCh: make(chan struct{}),
+		deviceAuthURL:  deviceAuthURL,
 	}
 	mux.HandleFunc("/callback", c.handleCallback)
+	// listen before serving in background, so that a busy port is returned as an error
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen callback port: %v", err)
+	}
+	log.Printf("INFO: Client is listening %s", listen)
 	go func() {
-		if err := c.server.ListenAndServe(); err != nil {
-			log.Fatal(err)
+		if err := c.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Printf("ERROR: callback server stopped: %s", err)
 		}
 	}()
 
@@ -98,9 +166,9 @@ func NewClient(issuerURL, clientID, clientSecret string, verifiedEmailClaimCheck
 }
 
 func (c *Client) Shutdown(ctx context.Context) error {
-	_ctx, _ := context.WithTimeout(ctx, 5*time.Second)
+	_ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
 	if err := c.server.Shutdown(_ctx); err != nil {
-		log.Fatal(err)
 		return err
 	}
 	return nil
@@ -117,6 +185,7 @@ func (c *Client) handleCallback(w http.ResponseWriter, r *http.Request) {
   "status": "error",
   "message": "please close this page."
 }`))
+		return
 	}
 
 	w.WriteHeader(200)
@@ -124,38 +193,128 @@ func (c *Client) handleCallback(w http.ResponseWriter, r *http.Request) {
   "status": "succeeded",
   "message": "please close this page."
 }`))
-	c.callbackWaitCh <- struct {}{}
+	select {
+	case c.callbackWaitCh <- struct{}{}:
+	default:
+		log.Print("INFO: nobody is waiting for the callback, discarding it")
+	}
 	log.Print("DEBUG: finish oidcutil.Client.handleCallback")
 }
 
 func (c *Client) exchange(r *http.Request) error {
 	log.Print("DEBUG: start oidcutil.Client.exchange")
 
-	// nonce check
-	state := r.URL.Query().Get("state")
-	if c.state != state {
-		return fmt.Errorf("state parameter mismatch: expected=%s, actual=%s", c.state, state)
+	authReq, err := c.popAuthRequest(r.URL.Query().Get("state"))
+	if err != nil {
+		return err
+	}
+
+	oauth2Token, err := c.oauth2Config.Exchange(c.oauth2Context(), r.URL.Query().Get("code"), c.resourceParams()...)
+	if err != nil {
+		return err
 	}
 
-	oauth2Token, err := c.oauth2Config.Exchange(context.Background(), r.URL.Query().Get("code"))
+	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
+	if !ok {
+		return errors.New("id_token is not a string")
+	}
+	idToken, err := c.verifier.Verify(context.Background(), rawIDToken)
 	if err != nil {
 		return err
 	}
+	if idToken.Nonce != authReq.nonce {
+		return errors.New("nonce claim mismatch")
+	}
 
 	log.Printf("DEBUG: received new oauth2 token: %+v", oauth2Token)
 
-	c.idTokenSource = NewIDTokenSource(
-		c.verifier,
-		c.oauth2Config.TokenSource(context.Background(), oauth2Token),
-		c.verifiedEmailClaimCheck,
-	)
+	c.newSession(oauth2Token)
 
 	log.Print("DEBUG: finish oidcutil.Client.exchange")
 	return nil
 }
 
-func (c *Client) authURL() string {
-	return c.oauth2Config.AuthCodeURL(c.state)
+// certificate returns the client certificate when the client authenticates with tls_client_auth, otherwise nil.
+func (c *Client) certificate() *tls.Certificate {
+	if tlsAuth, ok := c.auth.(*tlsClientAuth); ok {
+		return &tlsAuth.cert
+	}
+	return nil
+}
+
+// SetTokenCacheFile sets the file which refresh tokens obtained by any flow of the client are written to,
+// so that they survive agent restarts.
+func (c *Client) SetTokenCacheFile(path string) {
+	c.tokenCacheFile = path
+}
+
+// SetResource sets the resource indicator (RFC 8707) requested for access tokens.
+func (c *Client) SetResource(resource string) {
+	c.resource = resource
+}
+
+func (c *Client) resourceParams() []oauth2.AuthCodeOption {
+	if c.resource == "" {
+		return nil
+	}
+	return []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("resource", c.resource)}
+}
+
+// newSession starts to use the token, and refreshes it with its refresh token after it expires.
+func (c *Client) newSession(oauth2Token *oauth2.Token) {
+	var ts oauth2.TokenSource = c.oauth2Config.TokenSource(c.oauth2Context(), oauth2Token)
+	if c.tokenCacheFile != "" {
+		ts = &cachingTokenSource{ts: ts, path: c.tokenCacheFile}
+	}
+	c.idTokenSource = NewIDTokenSource(c.verifier, ts, c.verifiedEmailClaimCheck)
+}
+
+func (c *Client) oauth2Context() context.Context {
+	return context.WithValue(context.Background(), oauth2.HTTPClient, c.httpClient)
+}
+
+// newAuthRequest registers a new state/nonce pair and returns the authorization URL for it.
+// Previously issued pairs stay valid until they expire so that a retried login
+// doesn't invalidate the one the user is completing.
+func (c *Client) newAuthRequest() (string, error) {
+	state, err := newRandomString()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := newRandomString()
+	if err != nil {
+		return "", err
+	}
+
+	c.authReqMtx.Lock()
+	defer c.authReqMtx.Unlock()
+	now := time.Now()
+	for s, req := range c.authReqs {
+		if now.After(req.expiry) {
+			delete(c.authReqs, s)
+		}
+	}
+	c.authReqs[state] = &authRequest{
+		nonce:  nonce,
+		expiry: now.Add(authRequestTTL),
+	}
+
+	opts := append([]oauth2.AuthCodeOption{oidc.Nonce(nonce)}, c.resourceParams()...)
+	return c.oauth2Config.AuthCodeURL(state, opts...), nil
+}
+
+func (c *Client) popAuthRequest(state string) (*authRequest, error) {
+	c.authReqMtx.Lock()
+	defer c.authReqMtx.Unlock()
+	req, ok := c.authReqs[state]
+	if !ok {
+		return nil, errors.New("unknown state parameter")
+	}
+	delete(c.authReqs, state)
+	if time.Now().After(req.expiry) {
+		return nil, errors.New("authorization request expired")
+	}
+	return req, nil
 }
 
 func (c* Client) token() (*TokenWrapper, error) {
@@ -166,6 +325,7 @@ func (c* Client) token() (*TokenWrapper, error) {
 	if err != nil {
 		return nil, err
 	}
+	t.Certificate = c.certificate()
 	return t, nil
 }
 
@@ -173,8 +333,10 @@ func (c *Client) retrieveNewToken(ctx context.Context) (*TokenWrapper, error) {
 	log.Print("DEBUG: start oidcutil.Client.retrieveNewToken")
 
 	c.idTokenSource = nil
-	c.state = newState()
-	authURL := c.authURL()
+	authURL, err := c.newAuthRequest()
+	if err != nil {
+		return nil, err
+	}
 
 	log.Print("INFO: retrieving vew id token")
 	log.Print("INFO: opening ", authURL)
@@ -183,7 +345,6 @@ func (c *Client) retrieveNewToken(ctx context.Context) (*TokenWrapper, error) {
 	}
 
 	var t *TokenWrapper
-	var err error
 	L: for {
 		select {
 		case <-ctx.Done():
@@ -217,8 +378,9 @@ func (c *Client) Authenticate(ctx context.Context) (*TokenWrapper, error) {
 			err = ctx.Err()
 			break L
 		default:
-			childCtx, _ := context.WithCancel(ctx)
+			childCtx, cancel := context.WithCancel(ctx)
 			t, err = c.retrieveNewToken(childCtx)
+			cancel()
 			break L
 		}
 	}
@@ -0,0 +1,220 @@
+package oidcutil
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+const (
+	clientAssertionType     = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+	clientAssertionLifetime = 60 * time.Second
+)
+
+// ClientAuth authenticates the client on requests to the token endpoint.
+type ClientAuth interface {
+	Authenticate(req *http.Request, form url.Values, clientID, tokenURL string) error
+}
+
+type clientSecretAuth struct {
+	secret SecretSource
+}
+
+// NewClientSecretAuth returns a ClientAuth for client_secret_basic.
+func NewClientSecretAuth(secret SecretSource) ClientAuth {
+	return &clientSecretAuth{secret: secret}
+}
+
+func (a *clientSecretAuth) Authenticate(req *http.Request, form url.Values, clientID, tokenURL string) error {
+	secret, err := a.secret(req.Context())
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(url.QueryEscape(clientID), url.QueryEscape(secret))
+	return nil
+}
+
+type privateKeyJWTAuth struct {
+	signer jose.Signer
+}
+
+// NewPrivateKeyJWTAuth returns a ClientAuth for private_key_jwt (RFC 7523).
+// keyFile must contain a PEM encoded RSA or EC private key.
+func NewPrivateKeyJWTAuth(keyFile, keyID string) (ClientAuth, error) {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, alg, err := parsePrivateKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", keyFile, err)
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: alg, Key: jose.JSONWebKey{Key: key, KeyID: keyID}},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &privateKeyJWTAuth{signer: signer}, nil
+}
+
+func (a *privateKeyJWTAuth) Authenticate(req *http.Request, form url.Values, clientID, tokenURL string) error {
+	jti, err := newRandomString()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	assertion, err := jwt.Signed(a.signer).Claims(jwt.Claims{
+		Issuer:   clientID,
+		Subject:  clientID,
+		Audience: jwt.Audience{tokenURL},
+		ID:       jti,
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	}).CompactSerialize()
+	if err != nil {
+		return err
+	}
+	form.Set("client_id", clientID)
+	form.Set("client_assertion_type", clientAssertionType)
+	form.Set("client_assertion", assertion)
+	return nil
+}
+
+func parsePrivateKey(b []byte) (interface{}, jose.SignatureAlgorithm, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, "", errors.New("no PEM block found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return k, jose.ES256, nil
+		case elliptic.P384():
+			return k, jose.ES384, nil
+		case elliptic.P521():
+			return k, jose.ES512, nil
+		}
+		return nil, "", fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+	}
+	return nil, "", fmt.Errorf("unsupported private key type %T", key)
+}
+
+// clientAuthTransport applies a ClientAuth to every request sent to the token endpoint,
+// so that code exchange, refresh and any other grant are authenticated the same way.
+type clientAuthTransport struct {
+	base     http.RoundTripper
+	auth     ClientAuth
+	clientID string
+	tokenURL string
+	// other endpoints which require client authentication, e.g. device authorization endpoint
+	extraURLs []string
+}
+
+func (t *clientAuthTransport) authenticates(req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	u := req.URL.String()
+	if u == t.tokenURL {
+		return true
+	}
+	for _, extra := range t.extraURLs {
+		if u == extra {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *clientAuthTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.authenticates(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	form := url.Values{}
+	if req.Body != nil {
+		b, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if form, err = url.ParseQuery(string(b)); err != nil {
+			return nil, err
+		}
+	}
+
+	r := req.WithContext(req.Context())
+	r.Header = make(http.Header, len(req.Header))
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Del("Authorization")
+	if err := t.auth.Authenticate(r, form, t.clientID, t.tokenURL); err != nil {
+		return nil, fmt.Errorf("failed to authenticate token request: %v", err)
+	}
+	body := form.Encode()
+	r.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+	r.ContentLength = int64(len(body))
+	return t.base.RoundTrip(r)
+}
+
+type tlsClientAuth struct {
+	cert tls.Certificate
+}
+
+// NewTLSClientAuth returns a ClientAuth for tls_client_auth (RFC 8705).
+// The client is authenticated by the certificate presented in the TLS handshake.
+func NewTLSClientAuth(certFile, keyFile string) (ClientAuth, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsClientAuth{cert: cert}, nil
+}
+
+func (a *tlsClientAuth) Authenticate(req *http.Request, form url.Values, clientID, tokenURL string) error {
+	form.Set("client_id", clientID)
+	return nil
+}
+
+// CertificateThumbprint returns the base64url encoded SHA-256 thumbprint of the DER encoded certificate
+// as used in x5t#S256 confirmation claims.
+func CertificateThumbprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,264 @@
+package oidcutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+const (
+	deviceCodeGrantType       = "urn:ietf:params:oauth:grant-type:device_code"
+	defaultDeviceCodeInterval = 5 * time.Second
+	// used when the provider doesn't return expires_in of the device code
+	defaultDeviceCodeExpiry = 10 * time.Minute
+)
+
+// BrowserTokenSource returns a TokenSource which uses the current session,
+// or opens the browser and runs authorization code flow.
+func (c *Client) BrowserTokenSource() TokenSource {
+	return &browserTokenSource{client: c}
+}
+
+type browserTokenSource struct {
+	client *Client
+}
+
+func (s *browserTokenSource) Name() string {
+	return "browser"
+}
+
+func (s *browserTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	return s.client.Authenticate(ctx)
+}
+
+// RefreshTokenSource returns a TokenSource which uses the current session,
+// or the refresh token cached in cacheFile, which is written by the client with SetTokenCacheFile.
+func (c *Client) RefreshTokenSource(cacheFile string) TokenSource {
+	return &refreshTokenSource{client: c, cacheFile: cacheFile}
+}
+
+type refreshTokenSource struct {
+	client    *Client
+	cacheFile string
+}
+
+func (s *refreshTokenSource) Name() string {
+	return "refresh_token"
+}
+
+func (s *refreshTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	c := s.client
+	if t, err := c.token(); err == nil {
+		return t, nil
+	}
+
+	refreshToken, err := loadRefreshToken(s.cacheFile)
+	if err != nil {
+		return nil, err
+	}
+	// expired token with the refresh token forces refresh at the first use.
+	c.newSession(&oauth2.Token{RefreshToken: refreshToken, Expiry: time.Unix(1, 0)})
+	t, err := c.token()
+	if err != nil {
+		c.idTokenSource = nil
+		return nil, err
+	}
+	return t, nil
+}
+
+type cachedRefreshToken struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+func loadRefreshToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	cached := &cachedRefreshToken{}
+	if err := json.Unmarshal(b, cached); err != nil {
+		return "", fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if cached.RefreshToken == "" {
+		return "", fmt.Errorf("%s doesn't contain refresh token", path)
+	}
+	return cached.RefreshToken, nil
+}
+
+func saveRefreshToken(path, refreshToken string) error {
+	b, err := json.Marshal(&cachedRefreshToken{RefreshToken: refreshToken})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
+
+// cachingTokenSource writes refresh tokens to the cache file whenever they are issued or rotated.
+type cachingTokenSource struct {
+	ts    oauth2.TokenSource
+	path  string
+	saved string
+}
+
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+	t, err := s.ts.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t.RefreshToken != "" && t.RefreshToken != s.saved {
+		if err := saveRefreshToken(s.path, t.RefreshToken); err != nil {
+			log.Printf("ERROR: failed to cache refresh token to %s: %s", s.path, err)
+		} else {
+			s.saved = t.RefreshToken
+		}
+	}
+	return t, nil
+}
+
+// DeviceCodeTokenSource returns a TokenSource which uses the current session,
+// or runs device authorization grant (RFC 8628). The verification uri and user code are logged.
+// The grant waits for the user until the device code expires, regardless of the deadline of the caller.
+func (c *Client) DeviceCodeTokenSource() TokenSource {
+	return &deviceCodeTokenSource{client: c}
+}
+
+type deviceCodeTokenSource struct {
+	client *Client
+}
+
+func (s *deviceCodeTokenSource) Name() string {
+	return "device_code"
+}
+
+type deviceAuthResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int64  `json:"expires_in"`
+	Interval                int64  `json:"interval"`
+}
+
+type deviceTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int64  `json:"expires_in"`
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+func (s *deviceCodeTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	c := s.client
+	if t, err := c.token(); err == nil {
+		return t, nil
+	}
+	if c.deviceAuthURL == "" {
+		return nil, errors.New("provider doesn't support device authorization grant")
+	}
+
+	auth := &deviceAuthResponse{}
+	form := url.Values{
+		"client_id": {c.oauth2Config.ClientID},
+		"scope":     {strings.Join(c.oauth2Config.Scopes, " ")},
+	}
+	if c.resource != "" {
+		form.Set("resource", c.resource)
+	}
+	err := c.postForm(ctx, c.deviceAuthURL, form, auth)
+	if err != nil {
+		return nil, fmt.Errorf("device authorization request failed: %v", err)
+	}
+	if auth.VerificationURIComplete != "" {
+		log.Printf("INFO: to attest this node, visit %s", auth.VerificationURIComplete)
+	} else {
+		log.Printf("INFO: to attest this node, visit %s and enter code %s", auth.VerificationURI, auth.UserCode)
+	}
+
+	interval := defaultDeviceCodeInterval
+	if auth.Interval > 0 {
+		interval = time.Duration(auth.Interval) * time.Second
+	}
+	expiry := defaultDeviceCodeExpiry
+	if auth.ExpiresIn > 0 {
+		expiry = time.Duration(auth.ExpiresIn) * time.Second
+	}
+	// the caller must allow the user minutes to complete the grant, see config.Agent.FetchTimeout
+	ctx, cancel := context.WithTimeout(ctx, expiry)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(interval):
+		}
+
+		resp := &deviceTokenResponse{}
+		form := url.Values{
+			"grant_type":  {deviceCodeGrantType},
+			"device_code": {auth.DeviceCode},
+			"client_id":   {c.oauth2Config.ClientID},
+		}
+		if c.resource != "" {
+			form.Set("resource", c.resource)
+		}
+		err := c.postForm(ctx, c.oauth2Config.Endpoint.TokenURL, form, resp)
+		switch {
+		case resp.Error == "authorization_pending":
+			continue
+		case resp.Error == "slow_down":
+			interval += 5 * time.Second
+			continue
+		case resp.Error != "":
+			return nil, fmt.Errorf("device access token request failed: %s: %s", resp.Error, resp.ErrorDescription)
+		case err != nil:
+			return nil, fmt.Errorf("device access token request failed: %v", err)
+		}
+
+		oauth2Token := (&oauth2.Token{
+			AccessToken:  resp.AccessToken,
+			TokenType:    resp.TokenType,
+			RefreshToken: resp.RefreshToken,
+			Expiry:       time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+		}).WithExtra(map[string]interface{}{"id_token": resp.IDToken})
+		c.newSession(oauth2Token)
+		return c.token()
+	}
+}
+
+// postForm posts the form with client authentication and decodes json response into v.
+// v is decoded also on error responses so that callers can inspect oauth2 error codes.
+func (c *Client) postForm(ctx context.Context, endpoint string, form url.Values, v interface{}) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return fmt.Errorf("%s: %s", resp.Status, b)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, b)
+	}
+	return nil
+}
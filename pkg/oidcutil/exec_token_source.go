@@ -0,0 +1,116 @@
+package oidcutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cached tokens are refreshed this long before they expire.
+const execTokenExpirySkew = time.Minute
+
+// ExecTokenSource runs a credential helper command, like kubectl's exec credential plugins.
+// The command must print json like below to stdout:
+//
+//	{"id_token": "<jwt>", "expiration": "2019-05-01T00:00:00Z"}
+//
+// The token is cached until shortly before its expiration.
+type ExecTokenSource struct {
+	command  string
+	args     []string
+	env      map[string]string
+	timeout  time.Duration
+	verifier *Verifier
+
+	mtx    *sync.Mutex
+	cached *TokenWrapper
+	expiry time.Time
+}
+
+type execResponse struct {
+	IDToken    string    `json:"id_token"`
+	Expiration time.Time `json:"expiration"`
+}
+
+func NewExecTokenSource(verifier *Verifier, command string, args []string, env map[string]string, timeout time.Duration) *ExecTokenSource {
+	return &ExecTokenSource{
+		command:  command,
+		args:     args,
+		env:      env,
+		timeout:  timeout,
+		verifier: verifier,
+		mtx:      &sync.Mutex{},
+	}
+}
+
+func (s *ExecTokenSource) Name() string {
+	return "exec"
+}
+
+func (s *ExecTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.cached != nil && time.Now().Add(execTokenExpirySkew).Before(s.expiry) {
+		log.Print("DEBUG: using cached id token from exec credential helper")
+		return s.cached, nil
+	}
+
+	resp, err := s.run(ctx)
+	if err != nil {
+		log.Printf("ERROR: exec credential helper %s failed: %s", s.command, err)
+		return nil, err
+	}
+	t, err := s.verifier.Verify(ctx, resp.IDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := resp.Expiration
+	if expiry.IsZero() || t.IDToken.Expiry.Before(expiry) {
+		expiry = t.IDToken.Expiry
+	}
+	s.cached, s.expiry = t, expiry
+	return t, nil
+}
+
+func (s *ExecTokenSource) run(ctx context.Context) (*execResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, s.command, s.args...)
+	cmd.Env = os.Environ()
+	for k, v := range s.env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
+	}
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	err := cmd.Run()
+	if stderr.Len() > 0 {
+		log.Printf("INFO: exec credential helper %s stderr: %s", s.command, strings.TrimSpace(stderr.String()))
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("timed out after %s", s.timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &execResponse{}
+	if err := json.Unmarshal(stdout.Bytes(), resp); err != nil {
+		return nil, fmt.Errorf("failed to parse output: %v", err)
+	}
+	if resp.IDToken == "" {
+		return nil, errors.New("output doesn't contain id_token")
+	}
+	return resp, nil
+}
@@ -0,0 +1,50 @@
+package oidcutil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// FileTokenSource reads a pre-provisioned id token from a file,
+// e.g. kubernetes projected service account token.
+// The file is read on every call so that rotated tokens are picked up.
+type FileTokenSource struct {
+	name     string
+	path     string
+	verifier *Verifier
+}
+
+func NewFileTokenSource(verifier *Verifier, path string) *FileTokenSource {
+	return &FileTokenSource{
+		name:     "token_file",
+		path:     path,
+		verifier: verifier,
+	}
+}
+
+// NewKubernetesTokenSource reads the projected service account token.
+func NewKubernetesTokenSource(verifier *Verifier, path string) *FileTokenSource {
+	return &FileTokenSource{
+		name:     "kubernetes",
+		path:     path,
+		verifier: verifier,
+	}
+}
+
+func (s *FileTokenSource) Name() string {
+	return s.name
+}
+
+func (s *FileTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	b, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	rawIDToken := strings.TrimSpace(string(b))
+	if rawIDToken == "" {
+		return nil, fmt.Errorf("%s is empty", s.path)
+	}
+	return s.verifier.Verify(ctx, rawIDToken)
+}
@@ -0,0 +1,56 @@
+package oidcutil
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const gceIdentityPath = "/computeMetadata/v1/instance/service-accounts/default/identity"
+
+// GCETokenSource fetches the instance identity token from the GCE metadata server.
+type GCETokenSource struct {
+	metadataURL string
+	audience    string
+	verifier    *Verifier
+}
+
+func NewGCETokenSource(verifier *Verifier, metadataURL, audience string) *GCETokenSource {
+	return &GCETokenSource{
+		metadataURL: strings.TrimSuffix(metadataURL, "/"),
+		audience:    audience,
+		verifier:    verifier,
+	}
+}
+
+func (s *GCETokenSource) Name() string {
+	return "gce"
+}
+
+func (s *GCETokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	q := url.Values{}
+	q.Set("audience", s.audience)
+	q.Set("format", "full")
+	req, err := http.NewRequest(http.MethodGet, s.metadataURL+gceIdentityPath+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, b)
+	}
+	return s.verifier.Verify(ctx, strings.TrimSpace(string(b)))
+}
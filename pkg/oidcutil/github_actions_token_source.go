@@ -0,0 +1,80 @@
+package oidcutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+// GitHubActionsTokenSource requests an id token from GitHub Actions' OIDC provider.
+// The workflow job must have "id-token: write" permission.
+type GitHubActionsTokenSource struct {
+	audience string
+	verifier *Verifier
+}
+
+func NewGitHubActionsTokenSource(verifier *Verifier, audience string) *GitHubActionsTokenSource {
+	return &GitHubActionsTokenSource{
+		audience: audience,
+		verifier: verifier,
+	}
+}
+
+func (s *GitHubActionsTokenSource) Name() string {
+	return "github_actions"
+}
+
+func (s *GitHubActionsTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	requestURL := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL")
+	requestToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+	if requestURL == "" || requestToken == "" {
+		return nil, errors.New(
+			"ACTIONS_ID_TOKEN_REQUEST_URL and ACTIONS_ID_TOKEN_REQUEST_TOKEN must be set, check id-token permission of the job",
+		)
+	}
+
+	u, err := url.Parse(requestURL)
+	if err != nil {
+		return nil, err
+	}
+	if s.audience != "" {
+		q := u.Query()
+		q.Set("audience", s.audience)
+		u.RawQuery = q.Encode()
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "bearer "+requestToken)
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, b)
+	}
+
+	var body struct {
+		Value string `json:"value"`
+	}
+	if err := json.Unmarshal(b, &body); err != nil {
+		return nil, err
+	}
+	if body.Value == "" {
+		return nil, errors.New("response doesn't contain id token")
+	}
+	return s.verifier.Verify(ctx, body.Value)
+}
@@ -0,0 +1,34 @@
+package oidcutil
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// GitLabCITokenSource reads an id token from the CI/CD variable declared
+// in "id_tokens" of .gitlab-ci.yml.
+type GitLabCITokenSource struct {
+	variable string
+	verifier *Verifier
+}
+
+func NewGitLabCITokenSource(verifier *Verifier, variable string) *GitLabCITokenSource {
+	return &GitLabCITokenSource{
+		variable: variable,
+		verifier: verifier,
+	}
+}
+
+func (s *GitLabCITokenSource) Name() string {
+	return "gitlab_ci"
+}
+
+func (s *GitLabCITokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	rawIDToken := strings.TrimSpace(os.Getenv(s.variable))
+	if rawIDToken == "" {
+		return nil, fmt.Errorf("CI/CD variable %s is empty, check id_tokens of the job", s.variable)
+	}
+	return s.verifier.Verify(ctx, rawIDToken)
+}
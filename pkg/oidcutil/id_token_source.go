@@ -2,6 +2,7 @@ package oidcutil
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"github.com/coreos/go-oidc"
 	"golang.org/x/oauth2"
@@ -17,6 +18,10 @@ type TokenWrapper struct {
 	IDToken    *oidc.IDToken
 	RawIDToken string
 	Claims     *Claims
+	// access token issued together with the id token, empty unless it is obtained by oauth2 flows
+	AccessToken string
+	// client certificate which the token is bound to, nil unless it is obtained by oauth2 flows with tls_client_auth
+	Certificate *tls.Certificate
 }
 
 func NewIDTokenSource(verifier *oidc.IDTokenVerifier, ts oauth2.TokenSource, verifiedEmailClaimCheck bool) *IDTokenSource {
@@ -29,14 +34,19 @@ func NewIDTokenSource(verifier *oidc.IDTokenVerifier, ts oauth2.TokenSource, ver
 func (s *IDTokenSource) Token() (*TokenWrapper,  error) {
 	oauth2Token, err := s.ts.Token()
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
 	rawIDToken, ok := oauth2Token.Extra("id_token").(string)
 	if !ok {
 		err := errors.New("id_token is not a string")
-		log.Fatal(err)
+		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
-	return s.verifier.Verify(context.Background(), rawIDToken)
+	t, err := s.verifier.Verify(context.Background(), rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	t.AccessToken = oauth2Token.AccessToken
+	return t, nil
 }
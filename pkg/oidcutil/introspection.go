@@ -0,0 +1,209 @@
+package oidcutil
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// IntrospectionVerifier verifies opaque access tokens by token introspection (RFC 7662).
+// Fields of introspection responses are mapped to Claims the same way as id tokens.
+type IntrospectionVerifier struct {
+	endpoint   string
+	clientID   string
+	auth       ClientAuth
+	issuer     string
+	resource   string
+	httpClient *http.Client
+
+	cacheTTL time.Duration
+	mtx      sync.Mutex
+	cache    map[string]*introspectionResult
+}
+
+// introspectionResult keeps the raw response, which is mapped to fresh Claims on each hit
+// since callers modify Claims, e.g. by merging claim sources.
+type introspectionResult struct {
+	response []byte
+	expiry   time.Time
+}
+
+// NewIntrospectionVerifier returns a verifier which introspects tokens at endpoint with client credentials.
+// issuer is used when responses don't contain iss, and aud of responses must contain resource when it is set.
+func NewIntrospectionVerifier(endpoint, clientID string, auth ClientAuth, issuer, resource string, cacheTTL time.Duration) *IntrospectionVerifier {
+	return &IntrospectionVerifier{
+		endpoint:   endpoint,
+		clientID:   clientID,
+		auth:       auth,
+		issuer:     issuer,
+		resource:   resource,
+		httpClient: http.DefaultClient,
+		cacheTTL:   cacheTTL,
+		cache:      map[string]*introspectionResult{},
+	}
+}
+
+func (v *IntrospectionVerifier) Verify(ctx context.Context, rawAccessToken string) (*TokenWrapper, error) {
+	key := tokenHash(rawAccessToken)
+	b, cached := v.cached(key)
+	if cached {
+		log.Print("DEBUG: using cached introspection result")
+	} else {
+		var err error
+		b, err = v.introspect(ctx, rawAccessToken)
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return nil, err
+		}
+	}
+	claims, expiry, err := v.claims(b)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return nil, err
+	}
+	if !cached {
+		log.Printf("DEBUG: introspected access token successfuly: claims=%+v", claims)
+		v.store(key, b, expiry)
+	}
+	return &TokenWrapper{Claims: claims, AccessToken: rawAccessToken}, nil
+}
+
+func (v *IntrospectionVerifier) introspect(ctx context.Context, rawAccessToken string) ([]byte, error) {
+	form := url.Values{}
+	form.Set("token", rawAccessToken)
+	form.Set("token_type_hint", "access_token")
+	req, err := http.NewRequest(http.MethodPost, v.endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if err := v.auth.Authenticate(req, form, v.clientID, v.endpoint); err != nil {
+		return nil, fmt.Errorf("failed to authenticate introspection request: %v", err)
+	}
+	body := form.Encode()
+	req.Body = ioutil.NopCloser(bytes.NewBufferString(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection request failed: %s: %s", resp.Status, b)
+	}
+	return b, nil
+}
+
+// claims maps the response of an active token to Claims, and returns expiry of the token if any.
+func (v *IntrospectionVerifier) claims(b []byte) (*Claims, time.Time, error) {
+	var resp struct {
+		Active bool        `json:"active"`
+		Exp    int64       `json:"exp"`
+		Aud    interface{} `json:"aud"`
+	}
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, time.Time{}, fmt.Errorf("malformed introspection response: %v", err)
+	}
+	if !resp.Active {
+		return nil, time.Time{}, errors.New("access token is not active")
+	}
+	var expiry time.Time
+	if resp.Exp != 0 {
+		expiry = time.Unix(resp.Exp, 0)
+		if time.Now().After(expiry) {
+			return nil, time.Time{}, errors.New("access token is expired")
+		}
+	}
+	// aud is optional in introspection responses, but it is required when the resource is configured
+	// because tokens issued for other resources would be accepted otherwise
+	if v.resource != "" && !containsAudience(resp.Aud, v.resource) {
+		return nil, time.Time{}, fmt.Errorf("access token is not issued for %s", v.resource)
+	}
+
+	claims := &Claims{}
+	if err := claims.unmarshal(b); err != nil {
+		return nil, time.Time{}, err
+	}
+	// iss is optional in introspection responses
+	if claims.Issuer == "" {
+		claims.Issuer = v.issuer
+	}
+	if err := claims.Validate(); err != nil {
+		return nil, time.Time{}, err
+	}
+	if claims.ClientID == "" {
+		return nil, time.Time{}, errors.New("client_id field must not be empty")
+	}
+	return claims, expiry, nil
+}
+
+func (v *IntrospectionVerifier) cached(key string) ([]byte, bool) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	r, ok := v.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(r.expiry) {
+		delete(v.cache, key)
+		return nil, false
+	}
+	return r.response, true
+}
+
+func (v *IntrospectionVerifier) store(key string, response []byte, tokenExpiry time.Time) {
+	if v.cacheTTL <= 0 {
+		return
+	}
+	expiry := time.Now().Add(v.cacheTTL)
+	if !tokenExpiry.IsZero() && tokenExpiry.Before(expiry) {
+		expiry = tokenExpiry
+	}
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	now := time.Now()
+	for k, r := range v.cache {
+		if now.After(r.expiry) {
+			delete(v.cache, k)
+		}
+	}
+	v.cache[key] = &introspectionResult{response: response, expiry: expiry}
+}
+
+// tokenHash is the cache key of a token, so that raw tokens aren't kept in memory longer than needed.
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func containsAudience(aud interface{}, resource string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == resource
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == resource {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,158 @@
+package oidcutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-oidc"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// TenantPlaceholder is the placeholder of tenant ids in issuer templates,
+// as advertised by multi-tenant discovery documents of Azure AD.
+const TenantPlaceholder = "{tenantid}"
+
+// IssuerTemplate is an issuer url containing TenantPlaceholder,
+// e.g. https://login.microsoftonline.com/{tenantid}/v2.0
+type IssuerTemplate struct {
+	prefix string
+	suffix string
+}
+
+func NewIssuerTemplate(template string) (*IssuerTemplate, error) {
+	if strings.Count(template, TenantPlaceholder) != 1 {
+		return nil, fmt.Errorf("issuer template must contain exactly one %s: %s", TenantPlaceholder, template)
+	}
+	i := strings.Index(template, TenantPlaceholder)
+	return &IssuerTemplate{
+		prefix: template[:i],
+		suffix: template[i+len(TenantPlaceholder):],
+	}, nil
+}
+
+// Match returns the tenant id when issuer is an instance of the template.
+func (t *IssuerTemplate) Match(issuer string) (string, bool) {
+	if !strings.HasPrefix(issuer, t.prefix) || !strings.HasSuffix(issuer, t.suffix) {
+		return "", false
+	}
+	if len(issuer) <= len(t.prefix)+len(t.suffix) {
+		return "", false
+	}
+	tenant := issuer[len(t.prefix) : len(issuer)-len(t.suffix)]
+	if strings.ContainsAny(tenant, "/?#") {
+		return "", false
+	}
+	return tenant, true
+}
+
+// ResolveTenant sets the tenant of claims from their issuer, which must be an instance of the template.
+func (t *IssuerTemplate) ResolveTenant(claims *Claims) error {
+	tenant, ok := t.Match(claims.Issuer)
+	if !ok {
+		return fmt.Errorf("issuer %s doesn't match issuer template", claims.Issuer)
+	}
+	claims.Tenant = tenant
+	return nil
+}
+
+func (t *IssuerTemplate) Resolve(tenant string) string {
+	return t.prefix + tenant + t.suffix
+}
+
+// TokenVerifier verifies raw id tokens.
+type TokenVerifier interface {
+	Verify(ctx context.Context, rawIDToken string) (*TokenWrapper, error)
+}
+
+// MultiTenantVerifier verifies id tokens of the tenants in the allowlist.
+// The issuer of a token is resolved from its unverified iss claim, then the token is verified
+// by a verifier of the resolved issuer, whose keys are discovered from the issuer (or jwksFile).
+type MultiTenantVerifier struct {
+	template                *IssuerTemplate
+	allowedTenants          map[string]bool
+	jwksFile                string
+	config                  *oidc.Config
+	verifiedEmailClaimCheck bool
+
+	mtx       sync.Mutex
+	verifiers map[string]*Verifier
+}
+
+func NewMultiTenantVerifier(template *IssuerTemplate, allowedTenants []string, jwksFile string, config *oidc.Config, verifiedEmailClaimCheck bool) *MultiTenantVerifier {
+	allowed := map[string]bool{}
+	for _, tenant := range allowedTenants {
+		allowed[tenant] = true
+	}
+	return &MultiTenantVerifier{
+		template:                template,
+		allowedTenants:          allowed,
+		jwksFile:                jwksFile,
+		config:                  config,
+		verifiedEmailClaimCheck: verifiedEmailClaimCheck,
+		verifiers:               map[string]*Verifier{},
+	}
+}
+
+func (v *MultiTenantVerifier) Verify(ctx context.Context, rawIDToken string) (*TokenWrapper, error) {
+	issuer, err := unverifiedIssuer(rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	tenant, ok := v.template.Match(issuer)
+	if !ok {
+		return nil, fmt.Errorf("issuer %s doesn't match issuer template", issuer)
+	}
+	if !v.allowedTenants[tenant] {
+		return nil, fmt.Errorf("tenant %q is not allowed", tenant)
+	}
+
+	verifier, err := v.verifier(tenant)
+	if err != nil {
+		return nil, err
+	}
+	t, err := verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+	t.Claims.Tenant = tenant
+	return t, nil
+}
+
+func (v *MultiTenantVerifier) verifier(tenant string) (*Verifier, error) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if verifier, ok := v.verifiers[tenant]; ok {
+		return verifier, nil
+	}
+	issuerURL := v.template.Resolve(tenant)
+	log.Printf("DEBUG: creating verifier for tenant %s: issuer=%s", tenant, issuerURL)
+	// providers outlive the request, so discovery must not be bound to its context
+	idTokenVerifier, _, err := NewOIDCVerifier(context.Background(), issuerURL, v.jwksFile, v.config)
+	if err != nil {
+		return nil, err
+	}
+	verifier := NewIdTokenVerifier(idTokenVerifier, v.verifiedEmailClaimCheck)
+	v.verifiers[tenant] = verifier
+	return verifier, nil
+}
+
+// unverifiedIssuer returns iss claim of the token without verifying its signature.
+// It must only be used to select the verifier of the token.
+func unverifiedIssuer(rawIDToken string) (string, error) {
+	token, err := jwt.ParseSigned(rawIDToken)
+	if err != nil {
+		return "", fmt.Errorf("malformed jwt: %v", err)
+	}
+	claims := jwt.Claims{}
+	if err := token.UnsafeClaimsWithoutVerification(&claims); err != nil {
+		return "", fmt.Errorf("malformed jwt: %v", err)
+	}
+	if claims.Issuer == "" {
+		return "", errors.New("issuer claim must not be empty")
+	}
+	return claims.Issuer, nil
+}
@@ -1,9 +1,13 @@
 package oidcutil
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/coreos/go-oidc"
 	"github.com/hashicorp/go-multierror"
+	"strconv"
+	"strings"
 )
 
 type Claims struct {
@@ -11,11 +15,31 @@ type Claims struct {
 	Subject string `json:"sub"`
 	Email   string `json:"email"`
 	EmailVerified bool `json:"email_verified"`
+	Confirmation *Confirmation `json:"cnf,omitempty"`
+	// client_id and scope are claims of access tokens (RFC 9068)
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// tenant resolved from the issuer template, empty unless the issuer is multi-tenant
+	Tenant string `json:"-"`
+
+	// all claims in the token, used by profiles which need provider specific claims
+	Raw map[string]interface{} `json:"-"`
+	// names of claims in Raw which came from the UserInfo endpoint, not from the token
+	UserInfoClaims map[string]bool `json:"-"`
+}
+
+// Confirmation is the confirmation claim of certificate bound tokens (RFC 8705).
+type Confirmation struct {
+	X5tS256 string `json:"x5t#S256"`
 }
 
 func NewClaims(idToken *oidc.IDToken) (*Claims, error) {
+	var b json.RawMessage
+	if err := idToken.Claims(&b); err != nil {
+		return nil, err
+	}
 	claims := Claims{}
-	if err := idToken.Claims(&claims); err != nil {
+	if err := claims.unmarshal(b); err != nil {
 		return nil, err
 	}
 	if err := claims.Validate(); err != nil {
@@ -24,6 +48,14 @@ func NewClaims(idToken *oidc.IDToken) (*Claims, error) {
 	return &claims, nil
 }
 
+// unmarshal maps json claims of any kind of tokens, e.g. id tokens or introspection responses.
+func (c *Claims) unmarshal(b []byte) error {
+	if err := json.Unmarshal(b, c); err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.Raw)
+}
+
 func (c Claims) Validate() (err error) {
 	if c.Issuer == "" {
 		err = multierror.Append(err, errors.New("issuer claim must not be empty"))
@@ -31,8 +63,79 @@ func (c Claims) Validate() (err error) {
 	if c.Subject == "" {
 		err = multierror.Append(err, errors.New("subject claim must not be empty"))
 	}
+	return err
+}
+
+// ValidateEmail checks the claims carry a verified email, which is required to identify nodes by email.
+func (c *Claims) ValidateEmail() error {
 	if c.Email == "" {
-		err = multierror.Append(err, errors.New("email claim must not be empty"))
+		return errors.New("email claim must not be empty")
 	}
-	return err
+	if !c.EmailVerified {
+		return errors.New("email_verified claim must be true")
+	}
+	return nil
+}
+
+// Get returns the claim at the path of nested claim names in string form.
+// It returns false when the claim doesn't exist or isn't a scalar value.
+func (c *Claims) Get(path ...string) (string, bool) {
+	var v interface{} = c.Raw
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return "", false
+		}
+		if v, ok = m[name]; !ok {
+			return "", false
+		}
+	}
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	default:
+		return fmt.Sprintf("%v", v), true
+	}
+}
+
+// Scopes returns space separated scope claim as a list.
+func (c *Claims) Scopes() []string {
+	return strings.Fields(c.Scope)
+}
+
+// GetStrings returns the claim at the path as a list of strings,
+// e.g. roles or groups claims. A scalar claim is returned as a list of one value.
+func (c *Claims) GetStrings(path ...string) ([]string, bool) {
+	if v, ok := c.Get(path...); ok {
+		return []string{v}, true
+	}
+	var v interface{} = c.Raw
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, false
+	}
+	var values []string
+	for _, e := range list {
+		if s, ok := e.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values, true
 }
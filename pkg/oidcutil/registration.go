@@ -0,0 +1,150 @@
+package oidcutil
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/phayes/freeport"
+)
+
+const (
+	registrationClientName = "spire-agent oidc node attestor"
+	// software_id of registered clients (RFC 7591), which identifies agents of this plugin regardless of client_id
+	DefaultSoftwareID = "spire-agent-oidc-node-attestor"
+)
+
+// Registration is a client registered by dynamic client registration (RFC 7591).
+// It is persisted to a state file and reused after the agent restarts.
+type Registration struct {
+	ClientID                string `json:"client_id"`
+	ClientSecret            string `json:"client_secret"`
+	ClientSecretExpiresAt   int64  `json:"client_secret_expires_at,omitempty"`
+	RegistrationAccessToken string `json:"registration_access_token,omitempty"`
+	RegistrationClientURI   string `json:"registration_client_uri,omitempty"`
+	CallbackPort            int    `json:"callback_port"`
+}
+
+func (r *Registration) expired() bool {
+	return r.ClientSecretExpiresAt != 0 && time.Now().After(time.Unix(r.ClientSecretExpiresAt, 0))
+}
+
+// LoadOrRegisterClient loads the registration persisted in stateFile,
+// or registers a new client at the provider's registration_endpoint with initialAccessToken.
+// softwareID defaults to DefaultSoftwareID.
+func LoadOrRegisterClient(ctx context.Context, issuerURL, initialAccessToken, stateFile, softwareID string) (*Registration, error) {
+	if softwareID == "" {
+		softwareID = DefaultSoftwareID
+	}
+	reg, err := loadRegistration(stateFile)
+	switch {
+	case err == nil && !reg.expired():
+		log.Printf("INFO: loaded registered client from %s: client_id=%s", stateFile, reg.ClientID)
+		return reg, nil
+	case err == nil:
+		log.Printf("INFO: client secret of registered client %s expired, registering new client", reg.ClientID)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	reg, err = registerClient(ctx, issuerURL, initialAccessToken, softwareID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to register client: %v", err)
+	}
+	log.Printf("INFO: registered new client: client_id=%s", reg.ClientID)
+
+	if err := saveRegistration(stateFile, reg); err != nil {
+		return nil, err
+	}
+	return reg, nil
+}
+
+func registerClient(ctx context.Context, issuerURL, initialAccessToken, softwareID string) (*Registration, error) {
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, err
+	}
+	var metadata struct {
+		RegistrationEndpoint string `json:"registration_endpoint"`
+	}
+	if err := provider.Claims(&metadata); err != nil {
+		return nil, err
+	}
+	if metadata.RegistrationEndpoint == "" {
+		return nil, errors.New("provider doesn't support dynamic client registration")
+	}
+
+	port, err := freeport.GetFreePort()
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"client_name":                registrationClientName,
+		"software_id":                softwareID,
+		"redirect_uris":              []string{callbackURL(port)},
+		"grant_types":                []string{"authorization_code", "refresh_token"},
+		"response_types":             []string{"code"},
+		"token_endpoint_auth_method": "client_secret_basic",
+		"application_type":           "native",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, metadata.RegistrationEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+initialAccessToken)
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, b)
+	}
+
+	reg := &Registration{}
+	if err := json.Unmarshal(b, reg); err != nil {
+		return nil, err
+	}
+	if reg.ClientID == "" || reg.ClientSecret == "" {
+		return nil, errors.New("registration response doesn't contain client_id and client_secret")
+	}
+	reg.CallbackPort = port
+	return reg, nil
+}
+
+func loadRegistration(stateFile string) (*Registration, error) {
+	b, err := ioutil.ReadFile(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	reg := &Registration{}
+	if err := json.Unmarshal(b, reg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", stateFile, err)
+	}
+	return reg, nil
+}
+
+func saveRegistration(stateFile string, reg *Registration) error {
+	b, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(stateFile, b, 0600)
+}
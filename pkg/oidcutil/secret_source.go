@@ -0,0 +1,90 @@
+package oidcutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	commandSecretTimeout  = 30 * time.Second
+	commandSecretCacheTTL = time.Minute
+)
+
+// SecretSource returns the client secret. It is called on every token request
+// so that rotated secrets are picked up without restarting the agent.
+type SecretSource func(ctx context.Context) (string, error)
+
+func StaticSecret(secret string) SecretSource {
+	return func(ctx context.Context) (string, error) {
+		return secret, nil
+	}
+}
+
+func FileSecret(path string) SecretSource {
+	return func(ctx context.Context) (string, error) {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return nonEmptySecret(string(b), path)
+	}
+}
+
+func EnvSecret(name string) SecretSource {
+	return func(ctx context.Context) (string, error) {
+		return nonEmptySecret(os.Getenv(name), fmt.Sprintf("environment variable %s", name))
+	}
+}
+
+// CommandSecret runs the command with a timeout, and caches its output for a short while
+// so that a burst of token requests doesn't spawn a process each.
+func CommandSecret(command []string) SecretSource {
+	mtx := &sync.Mutex{}
+	var cached string
+	var expiry time.Time
+	return func(ctx context.Context) (string, error) {
+		if len(command) == 0 {
+			return "", errors.New("command must not be empty")
+		}
+		mtx.Lock()
+		defer mtx.Unlock()
+		if cached != "" && time.Now().Before(expiry) {
+			return cached, nil
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, commandSecretTimeout)
+		defer cancel()
+		stderr := &bytes.Buffer{}
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stderr = stderr
+		out, err := cmd.Output()
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("failed to run %s: timed out after %s", command[0], commandSecretTimeout)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to run %s: %v: %s", command[0], err, strings.TrimSpace(stderr.String()))
+		}
+		secret, err := nonEmptySecret(string(out), fmt.Sprintf("output of %s", command[0]))
+		if err != nil {
+			return "", err
+		}
+		cached, expiry = secret, time.Now().Add(commandSecretCacheTTL)
+		return secret, nil
+	}
+}
+
+func nonEmptySecret(secret, from string) (string, error) {
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return "", fmt.Errorf("client secret from %s is empty", from)
+	}
+	return secret, nil
+}
@@ -0,0 +1,53 @@
+package oidcutil
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/coreos/go-oidc"
+	"gopkg.in/square/go-jose.v2"
+)
+
+// staticKeySet verifies signatures with keys of a static JWKS,
+// for issuers which don't serve discovery documents, e.g. kubernetes api servers.
+type staticKeySet struct {
+	keys []jose.JSONWebKey
+}
+
+func NewStaticKeySetFromFile(path string) (oidc.KeySet, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	jwks := jose.JSONWebKeySet{}
+	if err := json.Unmarshal(b, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if len(jwks.Keys) == 0 {
+		return nil, fmt.Errorf("%s doesn't contain any keys", path)
+	}
+	return &staticKeySet{keys: jwks.Keys}, nil
+}
+
+func (s *staticKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	keyID := ""
+	if len(jws.Signatures) > 0 {
+		keyID = jws.Signatures[0].Header.KeyID
+	}
+	for _, key := range s.keys {
+		if keyID != "" && key.KeyID != "" && keyID != key.KeyID {
+			continue
+		}
+		if payload, err := jws.Verify(&key); err == nil {
+			return payload, nil
+		}
+	}
+	return nil, errors.New("failed to verify id token signature")
+}
@@ -0,0 +1,48 @@
+package oidcutil
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/hashicorp/go-multierror"
+)
+
+// TokenSource provides verified id tokens used for node attestation.
+type TokenSource interface {
+	// Name identifies the source in logs and configuration.
+	Name() string
+	Token(ctx context.Context) (*TokenWrapper, error)
+}
+
+// ChainTokenSource tries its sources in priority order and returns
+// the token from the first source which produces a valid one.
+type ChainTokenSource struct {
+	sources []TokenSource
+}
+
+func NewChainTokenSource(sources ...TokenSource) *ChainTokenSource {
+	return &ChainTokenSource{sources: sources}
+}
+
+func (s *ChainTokenSource) Name() string {
+	return "chain"
+}
+
+func (s *ChainTokenSource) Token(ctx context.Context) (*TokenWrapper, error) {
+	var errs error
+	for _, source := range s.sources {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		t, err := source.Token(ctx)
+		if err != nil {
+			log.Printf("INFO: skipping token source %s: %s", source.Name(), err)
+			errs = multierror.Append(errs, fmt.Errorf("%s: %v", source.Name(), err))
+			continue
+		}
+		log.Printf("INFO: fetched id token from token source %s", source.Name())
+		return t, nil
+	}
+	return nil, fmt.Errorf("no token source produced a valid id token: %v", errs)
+}
@@ -0,0 +1,53 @@
+package oidcutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc"
+	"golang.org/x/oauth2"
+)
+
+// EnrichWithUserInfo fetches claims from the UserInfo endpoint with the access token,
+// and merges them into claims. Claims in the token take precedence over UserInfo claims.
+func EnrichWithUserInfo(ctx context.Context, provider *oidc.Provider, accessToken string, claims *Claims) error {
+	if accessToken == "" {
+		return errors.New("access token is required to fetch userinfo")
+	}
+	userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+	if err != nil {
+		return err
+	}
+	// userinfo response must be about the same end-user (OpenID Connect Core 5.3.2)
+	if userInfo.Subject != claims.Subject {
+		return fmt.Errorf("sub of userinfo %q doesn't match sub of token %q", userInfo.Subject, claims.Subject)
+	}
+	raw := map[string]interface{}{}
+	if err := userInfo.Claims(&raw); err != nil {
+		return err
+	}
+	claims.mergeUserInfo(raw)
+	return nil
+}
+
+func (c *Claims) mergeUserInfo(raw map[string]interface{}) {
+	if c.Raw == nil {
+		c.Raw = map[string]interface{}{}
+	}
+	if c.UserInfoClaims == nil {
+		c.UserInfoClaims = map[string]bool{}
+	}
+	for name, v := range raw {
+		if _, ok := c.Raw[name]; ok {
+			continue
+		}
+		c.Raw[name] = v
+		c.UserInfoClaims[name] = true
+	}
+	if c.UserInfoClaims["email"] {
+		c.Email, _ = c.Get("email")
+		verified, _ := c.Get("email_verified")
+		c.EmailVerified = verified == "true"
+	}
+}
@@ -3,7 +3,6 @@ package oidcutil
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"github.com/coreos/go-oidc"
 	"log"
 )
@@ -20,23 +19,50 @@ func NewIdTokenVerifier(verifier *oidc.IDTokenVerifier, verifiedEmailClaimCheck
 	}
 }
 
+// NewVerifierForIssuer returns a Verifier for id tokens issued to clientID.
+// Keys are loaded from jwksFile when it is given, otherwise discovered from the issuer.
+func NewVerifierForIssuer(ctx context.Context, issuerURL, clientID, jwksFile string, verifiedEmailClaimCheck bool) (*Verifier, error) {
+	idTokenVerifier, _, err := NewOIDCVerifier(ctx, issuerURL, jwksFile, &oidc.Config{ClientID: clientID})
+	if err != nil {
+		return nil, err
+	}
+	return NewIdTokenVerifier(idTokenVerifier, verifiedEmailClaimCheck), nil
+}
+
+// NewOIDCVerifier returns go-oidc verifier of the issuer, and its provider when keys are discovered.
+func NewOIDCVerifier(ctx context.Context, issuerURL, jwksFile string, config *oidc.Config) (*oidc.IDTokenVerifier, *oidc.Provider, error) {
+	if jwksFile != "" {
+		keySet, err := NewStaticKeySetFromFile(jwksFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		return oidc.NewVerifier(issuerURL, keySet, config), nil, nil
+	}
+	provider, err := oidc.NewProvider(ctx, issuerURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	return provider.Verifier(config), provider, nil
+}
+
 func (v *Verifier) Verify(ctx context.Context, rawIDToken string) (*TokenWrapper, error) {
 	idToken, err := v.verifier.Verify(ctx, rawIDToken)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
 
 	claims, err := NewClaims(idToken)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("ERROR: %s", err)
 		return nil, err
 	}
 
-	if v.verifiedEmailClaimCheck && !claims.EmailVerified {
-		err = errors.New("email_verified claim must be true")
-		log.Fatal(err)
-		return nil, err
+	if v.verifiedEmailClaimCheck {
+		if err := claims.ValidateEmail(); err != nil {
+			log.Printf("ERROR: %s", err)
+			return nil, err
+		}
 	}
 
 	var c json.RawMessage
@@ -5,14 +5,73 @@ import (
 	"fmt"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/common"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/config"
+	"github.com/everpeace/oidc_attestor_plugin/pkg/oidcutil"
 	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/hcl"
 	spi "github.com/spiffe/spire/proto/common/plugin"
+	"strings"
+	"time"
+)
+
+const defaultNodeTTL = 720 * time.Hour
+
+const (
+	SelectorHashingNone = "none"
+	SelectorHashingBoth = "both"
+	SelectorHashingOnly = "only"
 )
 
 type Config struct {
-	config.Common    `hcl:",squash"`
-	common.IDGenMode `hcl:",squash"`
+	config.Common          `hcl:",squash"`
+	common.IDGenMode       `hcl:",squash"`
+	common.HostFactsConfig `hcl:",squash"`
+
+	// type of selectors, defaults to plugin_name. distinguishes instances of this plugin with different issuers
+	SelectorType string `hcl:"selector_type"`
+
+	// accepts id tokens issued to any of these clients instead of client_id, e.g. dynamically registered agents.
+	// checked against azp claim, or aud claim when azp is absent
+	AllowedClientIDs []string `hcl:"allowed_client_ids"`
+	// accepts id tokens of dynamically registered agents without listing their client ids,
+	// when software_id claim set by the issuer from the registration is one of these
+	AllowedSoftwareIDs []string `hcl:"allowed_software_ids"`
+
+	// tenants accepted by azure profile or issuer_template, defaults to azure_tenant_id
+	AllowedTenantIDs []string `hcl:"allowed_tenant_ids"`
+
+	// verifies opaque access tokens by token introspection instead of as JWTs
+	Introspection *config.Introspection `hcl:"introspection"`
+
+	// merges claims from the UserInfo endpoint with the access token sent by the agent
+	UserInfo bool `hcl:"userinfo"`
+	// userinfo claims emitted as "userinfo.<name>:<value>" selectors, defaults to all merged claims
+	UserInfoSelectorClaims []string `hcl:"userinfo_selector_claims"`
+
+	// resolves aggregated and distributed claims, e.g. groups of users in too many groups of Azure AD
+	ResolveClaimSources bool `hcl:"resolve_claim_sources"`
+	// issuers of aggregated claims JWTs trusted in addition to the issuer of the token
+	ClaimSourceIssuers []string `hcl:"claim_source_issuers"`
+	// additional claims emitted as "<name>:<value>" selectors, list claims like groups emit one selector per value
+	SelectorClaims []string `hcl:"selector_claims"`
+
+	// limits distinct nodes attested by each subject, 0 means unlimited. requires node_store_file
+	MaxNodesPerSubject int `hcl:"max_nodes_per_subject"`
+	// local file which tracks nodes of each subject
+	NodeStoreFile string `hcl:"node_store_file"`
+	// duration after which nodes not attested again are forgotten, defaults to 720h. "0s" keeps nodes forever
+	NodeTTL string `hcl:"node_ttl"`
+
+	// emits HMAC of identifying selectors (subject, email, username, service_account, oid, userinfo.* etc.)
+	// "both" alongside or "only" instead of raw ones.
+	// requires hmac_key_file
+	SelectorHashing string `hcl:"selector_hashing"`
+
+	// emits "issuer:<issuer url>" selectors along with "issuer:<issuer alias>" during migration to issuer_alias
+	LegacyIssuerSelectors bool `hcl:"legacy_issuer_selectors"`
+
+	// requires id tokens to be bound to the agent's tls client certificate (RFC 8705),
+	// whose key the agent proves possession of by signing a nonce challenge
+	VerifyCertificateBinding bool `hcl:"verify_certificate_binding"`
 }
 
 func (c *Config) Validate() (err error) {
@@ -20,13 +79,156 @@ func (c *Config) Validate() (err error) {
 		err = multierror.Append(err, _err)
 	}
 
+	if c.ExpectedAudience() == "" && !c.checksClients() && !c.UsesAccessToken() {
+		err = multierror.Append(err, errors.New("client_id, audience, allowed_client_ids or allowed_software_ids must not be empty"))
+	}
+	if c.checksClients() && c.UsesAccessToken() {
+		err = multierror.Append(err, errors.New("allowed_client_ids and allowed_software_ids can't be used when token_type is access_token"))
+	}
+
+	if c.IssuerTemplate != "" {
+		if _, _err := oidcutil.NewIssuerTemplate(c.IssuerTemplate); _err != nil {
+			err = multierror.Append(err, _err)
+		}
+		if len(c.AllowedTenantIDs) == 0 {
+			err = multierror.Append(err, errors.New("allowed_tenant_ids must not be empty when issuer_template is set"))
+		}
+	}
+
+	if c.IssuerTemplate != "" && c.UsesAccessToken() {
+		err = multierror.Append(err, errors.New("issuer_template can't be used when token_type is access_token"))
+	}
+
+	if c.Introspection != nil {
+		if !c.UsesAccessToken() {
+			err = multierror.Append(err, errors.New("token_type must be access_token when introspection is set"))
+		}
+		if _err := c.Introspection.Validate(); _err != nil {
+			err = multierror.Append(err, _err)
+		}
+	}
+
+	if c.UserInfo && (c.JWKSFile != "" || c.IssuerTemplate != "" || c.Introspection != nil) {
+		err = multierror.Append(err, errors.New("userinfo can't be used with jwks_file, issuer_template or introspection"))
+	}
+
+	if _err := common.ValidateTrustDomain(c.TrustDomain); c.TrustDomain != "" && _err != nil {
+		err = multierror.Append(err, _err)
+	}
+
+	if strings.Contains(c.SelectorType, ":") {
+		err = multierror.Append(err, errors.New("selector_type must not contain ':'"))
+	}
+
+	if c.IsHashed() && c.HMACKeyFile == "" {
+		err = multierror.Append(err, fmt.Errorf("hmac_key_file must not be empty for mode %s", c.Mode))
+	}
+	switch c.SelectorHashing {
+	case "", SelectorHashingNone:
+	case SelectorHashingBoth, SelectorHashingOnly:
+		if c.HMACKeyFile == "" {
+			err = multierror.Append(err, errors.New("hmac_key_file must not be empty when selector_hashing is set"))
+		}
+	default:
+		err = multierror.Append(err, fmt.Errorf("selector_hashing must be one of %s,%s,%s",
+			SelectorHashingNone, SelectorHashingBoth, SelectorHashingOnly,
+		))
+	}
+
+	if c.LegacyIssuerSelectors && c.IssuerAlias == "" {
+		err = multierror.Append(err, errors.New("issuer_alias must not be empty when legacy_issuer_selectors is set"))
+	}
+
+	if c.MaxNodesPerSubject < 0 {
+		err = multierror.Append(err, errors.New("max_nodes_per_subject must not be negative"))
+	}
+	if c.MaxNodesPerSubject > 0 && c.NodeStoreFile == "" {
+		err = multierror.Append(err, errors.New("node_store_file must not be empty when max_nodes_per_subject is set"))
+	}
+	if ttl, _err := c.NodeTTLDuration(); _err != nil {
+		err = multierror.Append(err, fmt.Errorf("node_ttl is invalid: %v", _err))
+	} else if ttl < 0 {
+		err = multierror.Append(err, errors.New("node_ttl must not be negative"))
+	}
+
+	if c.Profile == config.ProfileAzure && len(c.AllowedTenantIDs) == 0 {
+		err = multierror.Append(err, errors.New("azure_tenant_id or allowed_tenant_ids must not be empty for azure profile"))
+	}
+
 	if _err := c.IDGenMode.Validate(); _err != nil {
 		err = multierror.Append(err, _err)
 	}
+	if _err := c.IDGenMode.ValidateIssuerAlias(c.IssuerAlias); _err != nil {
+		err = multierror.Append(err, _err)
+	}
+
+	if _err := c.HostFactsConfig.Validate(); _err != nil {
+		err = multierror.Append(err, _err)
+	}
 
 	return
 }
 
+func (c *Config) NodeTTLDuration() (time.Duration, error) {
+	if c.NodeTTL == "" {
+		return defaultNodeTTL, nil
+	}
+	return time.ParseDuration(c.NodeTTL)
+}
+
+// HashesSelectors reports whether identifying selectors are hashed with the HMAC key.
+func (c *Config) HashesSelectors() bool {
+	return c.SelectorHashing == SelectorHashingBoth || c.SelectorHashing == SelectorHashingOnly
+}
+
+// AuthorizeClaims checks allowed clients and profile specific restrictions on verified claims.
+func (c *Config) AuthorizeClaims(claims *oidcutil.Claims) error {
+	if c.checksClients() && !c.UsesAccessToken() {
+		if err := c.authorizeClient(claims); err != nil {
+			return err
+		}
+	}
+	if c.Profile == config.ProfileAzure {
+		tenantID, _ := claims.Get("tid")
+		for _, allowed := range c.AllowedTenantIDs {
+			if tenantID == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("tenant %q is not allowed", tenantID)
+	}
+	return nil
+}
+
+// checksClients reports whether clients are checked by allowed_client_ids or allowed_software_ids instead of aud.
+func (c *Config) checksClients() bool {
+	return len(c.AllowedClientIDs) > 0 || len(c.AllowedSoftwareIDs) > 0
+}
+
+// authorizeClient checks the token is issued to one of allowed clients, or to a client of allowed software.
+// azp is the party the token is issued to when it is present, otherwise aud is.
+func (c *Config) authorizeClient(claims *oidcutil.Claims) error {
+	if softwareID, ok := claims.Get("software_id"); ok {
+		for _, allowed := range c.AllowedSoftwareIDs {
+			if softwareID == allowed {
+				return nil
+			}
+		}
+	}
+	clients, _ := claims.GetStrings("aud")
+	if azp, ok := claims.Get("azp"); ok && azp != "" {
+		clients = []string{azp}
+	}
+	for _, client := range clients {
+		for _, allowed := range c.AllowedClientIDs {
+			if client == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("id token is issued to %v, which is not in allowed_client_ids nor of allowed_software_ids", clients)
+}
+
 func NewConfig(req *spi.ConfigureRequest) (*Config, error) {
 	config := &Config{}
 	if err := hcl.Decode(config, req.Configuration); err != nil {
@@ -37,6 +239,17 @@ func NewConfig(req *spi.ConfigureRequest) (*Config, error) {
 		return nil, errors.New("global configuration is required")
 	}
 	config.TrustDomain = req.GlobalConfig.TrustDomain
+	config.SetDefaults()
+	if config.IssuerURL == "" {
+		// tokens are verified against the issuer resolved from issuer_template
+		config.IssuerURL = config.IssuerTemplate
+	}
+	if config.SelectorType == "" {
+		config.SelectorType = config.PluginName
+	}
+	if len(config.AllowedTenantIDs) == 0 && config.AzureTenantID != "" {
+		config.AllowedTenantIDs = []string{config.AzureTenantID}
+	}
 	if err := config.Validate(); err != nil {
 		return nil, err
 	}
@@ -0,0 +1,103 @@
+package nodeattestor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// nodeStore tracks distinct nodes attested by each subject in a local json file,
+// so that the number of nodes per subject can be limited.
+// Nodes which haven't attested for ttl are evicted, so that decommissioned nodes free their slots.
+type nodeStore struct {
+	path string
+	ttl  time.Duration
+	mtx  sync.Mutex
+}
+
+// last seen time of each node of each subject
+type nodeRecords map[string]map[string]time.Time
+
+func newNodeStore(path string, ttl time.Duration) *nodeStore {
+	return &nodeStore{path: path, ttl: ttl}
+}
+
+// Register records the node of the subject, and fails when the subject already has max other nodes.
+func (s *nodeStore) Register(subject, nodeID string, max int) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	nodes, err := s.load()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	s.evict(nodes, now)
+	if _, ok := nodes[subject][nodeID]; !ok && len(nodes[subject]) >= max {
+		return fmt.Errorf("%s has already attested %d nodes, which is the maximum", subject, len(nodes[subject]))
+	}
+	if nodes[subject] == nil {
+		nodes[subject] = map[string]time.Time{}
+	}
+	nodes[subject][nodeID] = now
+	return s.save(nodes)
+}
+
+// evict removes nodes which haven't attested for ttl, ttl of 0 keeps nodes forever.
+func (s *nodeStore) evict(nodes nodeRecords, now time.Time) {
+	if s.ttl <= 0 {
+		return
+	}
+	for subject, lastSeen := range nodes {
+		for nodeID, t := range lastSeen {
+			if now.Sub(t) > s.ttl {
+				log.Printf("INFO: evicting node %s of %s, last seen at %s", nodeID, subject, t)
+				delete(lastSeen, nodeID)
+			}
+		}
+		if len(lastSeen) == 0 {
+			delete(nodes, subject)
+		}
+	}
+}
+
+func (s *nodeStore) load() (nodeRecords, error) {
+	nodes := nodeRecords{}
+	b, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nodes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &nodes); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", s.path, err)
+	}
+	return nodes, nil
+}
+
+func (s *nodeStore) save(nodes nodeRecords) error {
+	b, err := json.MarshalIndent(nodes, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so that a crash doesn't leave a truncated store
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
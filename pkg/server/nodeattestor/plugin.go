@@ -2,13 +2,14 @@ package nodeattestor
 
 import (
 	"context"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/coreos/go-oidc"
-	"github.com/everpeace/oidc_attestor_plugin/pkg"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/common"
 	"github.com/everpeace/oidc_attestor_plugin/pkg/oidcutil"
-	spc "github.com/spiffe/spire/proto/common"
 	spi "github.com/spiffe/spire/proto/common/plugin"
 	"github.com/spiffe/spire/proto/server/nodeattestor"
 	"log"
@@ -22,7 +23,10 @@ type Plugin struct {
 
 	config *Config
 	provider *oidc.Provider
-	verifier *oidcutil.Verifier
+	verifier oidcutil.TokenVerifier
+	claimSourceResolver *oidcutil.ClaimSourceResolver
+	nodeStore *nodeStore
+	hmacKey []byte
 }
 
 func New() *Plugin {
@@ -40,6 +44,9 @@ func (p *Plugin) Attest(stream nodeattestor.Attest_PluginStream) error {
 	if err := p.assertConfigured(); err != nil {
 		return errors.New("plugin not configured")
 	}
+	if (p.config.IsHashed() || p.config.HashesSelectors()) && p.hmacKey == nil {
+		return errors.New("hmac key is not loaded")
+	}
 
 	returnInvalid := func() error {
 		err := stream.Send(&nodeattestor.AttestResponse{
@@ -58,48 +65,104 @@ func (p *Plugin) Attest(stream nodeattestor.Attest_PluginStream) error {
 		return returnInvalid()
 	}
 
-	rawIDToken := string(req.AttestationData.Data)
-	t, err := p.verifier.Verify(context.Background(), rawIDToken)
+	data, err := common.ParseAttestationData(req.AttestationData.Data)
+	if err != nil {
+		log.Printf("ERROR: failed to parse attestation data: %s", err)
+		return returnInvalid()
+	}
+	log.Printf("DEBUG: attestation data version=%d, agent plugin version=%q", data.Version, data.PluginVersion)
+	rawToken := data.IDToken
+	if p.config.UsesAccessToken() {
+		rawToken = data.AccessToken
+	}
+	t, err := p.verifier.Verify(context.Background(), rawToken)
 
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("ERROR: %s", err)
+		return returnInvalid()
+	}
+
+	if p.config.UserInfo {
+		if err := oidcutil.EnrichWithUserInfo(context.Background(), p.provider, data.AccessToken, t.Claims); err != nil {
+			log.Printf("ERROR: failed to fetch userinfo: %s", err)
+			return returnInvalid()
+		}
+	}
+	// id token verifiers check email themselves unless it is merged from userinfo afterwards,
+	// access token and introspection verifiers don't check it at all
+	if p.config.RequiresEmail() && (p.config.UserInfo || p.config.UsesAccessToken()) {
+		if err := t.Claims.ValidateEmail(); err != nil {
+			log.Printf("ERROR: %s", err)
+			return returnInvalid()
+		}
+	}
+
+	if p.claimSourceResolver != nil {
+		p.claimSourceResolver.Resolve(context.Background(), t.Claims, data.AccessToken)
+	}
+
+	if err := p.config.CanonicalizeEmail(t.Claims); err != nil {
+		log.Printf("ERROR: %s", err)
+		return returnInvalid()
+	}
+
+	if err := p.config.AuthorizeClaims(t.Claims); err != nil {
+		log.Printf("ERROR: %s", err)
+		return returnInvalid()
+	}
+
+	if p.config.VerifyCertificateBinding {
+		cert, err := verifyCertificateBinding(t.Claims, data.Certificate)
+		if err != nil {
+			log.Printf("ERROR: %s", err)
+			return returnInvalid()
+		}
+		if err := challengeCertificateKey(stream, cert); err != nil {
+			log.Printf("ERROR: %s", err)
+			return returnInvalid()
+		}
+	}
+
+	if p.config.RequiresNodeID() || p.nodeStore != nil || data.NodeID != "" {
+		if err := common.ValidateNodeID(data.NodeID); err != nil {
+			log.Printf("ERROR: %s", err)
+			return returnInvalid()
+		}
+	}
+	spiffeID, err := p.config.GenerateSpiffeId(common.IDInput{
+		TrustDomain: p.config.TrustDomain,
+		IssuerAlias: p.config.IssuerAlias,
+		Claims:      t.Claims,
+		NodeID:      data.NodeID,
+		HMACKey:     p.hmacKey,
+	})
+	if err != nil {
+		log.Printf("ERROR: %s", err)
 		return returnInvalid()
 	}
 
-	var selectors []*spc.Selector
-	switch p.config.Mode {
-	case common.IDGenModeIssuerAndSubject:
-		selectors = []*spc.Selector {
-			{
-				Type:  pkg.PluginName,
-				Value: fmt.Sprintf("issuer:%s", t.Claims.Issuer),
-			},
-			{
-				Type:  pkg.PluginName,
-				Value: fmt.Sprintf("subject:%s", t.Claims.Subject),
-			},
+	if p.nodeStore != nil {
+		// the store file doesn't keep raw subjects when hmac key is loaded
+		subject := fmt.Sprintf("%s %s", t.Claims.Issuer, t.Claims.Subject)
+		if p.hmacKey != nil {
+			subject = common.HashIdentifier(p.hmacKey, t.Claims.Issuer, t.Claims.Subject)
 		}
-	case common.IDGenModeEmail:
-		selectors = []*spc.Selector {
-			{
-				Type:  pkg.PluginName,
-				Value: fmt.Sprintf("issuer:%s", t.Claims.Issuer),
-			},
-			{
-				Type:  pkg.PluginName,
-				Value: fmt.Sprintf("email:%s", t.Claims.Email),
-			},
-			{
-				Type:  pkg.PluginName,
-				Value: fmt.Sprintf("email_verified:%v", t.Claims.EmailVerified),
-			},
+		if err := p.nodeStore.Register(subject, data.NodeID, p.config.MaxNodesPerSubject); err != nil {
+			log.Printf("ERROR: %s", err)
+			return returnInvalid()
 		}
 	}
 
+	selectors, err := p.config.Selectors(t.Claims, data, p.hmacKey)
+	if err != nil {
+		log.Printf("ERROR: %s", err)
+		return returnInvalid()
+	}
+
 	// should we whitelisted??
 	resp := &nodeattestor.AttestResponse{
 		Valid:        true,
-		BaseSPIFFEID: p.config.GenerateSpiffeId(p.config.TrustDomain, t.Claims),
+		BaseSPIFFEID: spiffeID,
 		Selectors: selectors,
 	}
 
@@ -117,7 +180,7 @@ func (p *Plugin) Attest(stream nodeattestor.Attest_PluginStream) error {
 	strings.TrimRight(strSelectors, ",")
 	log.Printf(
 		"INFO: %s node attest finished: Spiffe-id: %s, selectors: %s",
-		pkg.PluginName,
+		p.config.PluginName,
 		resp.GetBaseSPIFFEID(),
 		strSelectors,
 	)
@@ -137,29 +200,158 @@ func (p *Plugin) Configure(ctx context.Context, req *spi.ConfigureRequest) (*spi
 	}
 	log.Printf("DEBUG: loaded configuration successfuly: %+v", config)
 
-	p.config = config
-	provider, err := oidc.NewProvider(context.Background(), config.IssuerURL)
+	verifiedEmailClaimCheck := false
+	// with userinfo, email is checked after it is merged from userinfo
+	if config.RequiresEmail() && !config.UserInfo {
+		verifiedEmailClaimCheck = true
+	}
+	verifier, provider, err := newVerifier(config, verifiedEmailClaimCheck)
 	if err != nil {
 		return &spi.ConfigureResponse{ErrorList: []string{err.Error()}}, nil
 	}
-	p.provider = provider
-	verifiedEmailClaimCheck := false
-	if p.config.Mode == common.IDGenModeEmail {
-		verifiedEmailClaimCheck = true
+	var hmacKey []byte
+	if config.HMACKeyFile != "" {
+		hmacKey, err = common.LoadHMACKey(config.HMACKeyFile)
+		if err != nil {
+			return &spi.ConfigureResponse{ErrorList: []string{err.Error()}}, nil
+		}
+	}
+	var store *nodeStore
+	if config.MaxNodesPerSubject > 0 {
+		ttl, _ := config.NodeTTLDuration()
+		store = newNodeStore(config.NodeStoreFile, ttl)
+	}
+	var claimSourceResolver *oidcutil.ClaimSourceResolver
+	if config.ResolveClaimSources {
+		claimSourceResolver = oidcutil.NewClaimSourceResolver(config.ClaimSourceIssuers)
 	}
-	idTokenVerifier := provider.Verifier(&oidc.Config{ClientID: config.ClientID})
-	p.verifier = oidcutil.NewIdTokenVerifier(idTokenVerifier, verifiedEmailClaimCheck)
+
+	// the plugin keeps the previous configuration unless everything above succeeded
+	p.config = config
+	// provider is nil when keys are given by jwks_file or the issuer is multi-tenant
+	p.provider = provider
+	p.verifier = verifier
+	p.hmacKey = hmacKey
+	p.nodeStore = store
+	p.claimSourceResolver = claimSourceResolver
 
 	log.Print("DEBUG: finish Configure")
 	return &spi.ConfigureResponse{}, nil
 }
 
+func newVerifier(config *Config, verifiedEmailClaimCheck bool) (oidcutil.TokenVerifier, *oidc.Provider, error) {
+	oidcConfig := &oidc.Config{
+		ClientID:          config.ExpectedAudience(),
+		// allowed_client_ids and allowed_software_ids are checked by AuthorizeClaims
+		SkipClientIDCheck: config.checksClients(),
+	}
+	if config.Introspection != nil {
+		verifier, err := newIntrospectionVerifier(config)
+		return verifier, nil, err
+	}
+	if config.UsesAccessToken() {
+		// audience of access tokens is the resource, not the client
+		idTokenVerifier, provider, err := oidcutil.NewOIDCVerifier(
+			context.Background(), config.IssuerURL, config.JWKSFile, &oidc.Config{ClientID: config.Resource},
+		)
+		if err != nil {
+			return nil, nil, err
+		}
+		return oidcutil.NewAccessTokenVerifier(idTokenVerifier), provider, nil
+	}
+	if config.IssuerTemplate != "" {
+		template, err := oidcutil.NewIssuerTemplate(config.IssuerTemplate)
+		if err != nil {
+			return nil, nil, err
+		}
+		return oidcutil.NewMultiTenantVerifier(
+			template, config.AllowedTenantIDs, config.JWKSFile, oidcConfig, verifiedEmailClaimCheck,
+		), nil, nil
+	}
+	idTokenVerifier, provider, err := oidcutil.NewOIDCVerifier(
+		context.Background(), config.IssuerURL, config.JWKSFile, oidcConfig,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return oidcutil.NewIdTokenVerifier(idTokenVerifier, verifiedEmailClaimCheck), provider, nil
+}
+
+func newIntrospectionVerifier(config *Config) (*oidcutil.IntrospectionVerifier, error) {
+	endpoint := config.Introspection.Endpoint
+	if endpoint == "" {
+		provider, err := oidc.NewProvider(context.Background(), config.IssuerURL)
+		if err != nil {
+			return nil, err
+		}
+		var metadata struct {
+			IntrospectionEndpoint string `json:"introspection_endpoint"`
+		}
+		if err := provider.Claims(&metadata); err != nil {
+			return nil, err
+		}
+		if metadata.IntrospectionEndpoint == "" {
+			return nil, errors.New("issuer doesn't advertise introspection_endpoint, introspection.endpoint must be set")
+		}
+		endpoint = metadata.IntrospectionEndpoint
+	}
+	secret := oidcutil.StaticSecret(config.Introspection.ClientSecret)
+	if config.Introspection.ClientSecretFile != "" {
+		secret = oidcutil.FileSecret(config.Introspection.ClientSecretFile)
+	}
+	cacheTTL, _ := config.Introspection.CacheTTLDuration()
+	return oidcutil.NewIntrospectionVerifier(
+		endpoint, config.Introspection.ClientID, oidcutil.NewClientSecretAuth(secret),
+		config.IssuerURL, config.Resource, cacheTTL,
+	), nil
+}
+
 func (p *Plugin) GetPluginInfo(context.Context, *spi.GetPluginInfoRequest) (*spi.GetPluginInfoResponse, error) {
 	return &spi.GetPluginInfoResponse{}, nil
 }
 
+// verifyCertificateBinding returns the certificate sent by the agent when the token is bound to it.
+// The certificate is public, the agent must prove possession of its key by challengeCertificateKey.
+func verifyCertificateBinding(claims *oidcutil.Claims, der []byte) (*x509.Certificate, error) {
+	if len(der) == 0 {
+		return nil, errors.New("attestation data doesn't contain certificate")
+	}
+	if claims.Confirmation == nil || claims.Confirmation.X5tS256 == "" {
+		return nil, errors.New("id token is not bound to a certificate")
+	}
+	thumbprint := oidcutil.CertificateThumbprint(der)
+	if subtle.ConstantTimeCompare([]byte(claims.Confirmation.X5tS256), []byte(thumbprint)) != 1 {
+		return nil, errors.New("cnf.x5t#S256 claim doesn't match the agent's certificate thumbprint")
+	}
+	return x509.ParseCertificate(der)
+}
+
+// challengeCertificateKey sends a nonce to the agent, and verifies the agent signed it with the key of cert.
+func challengeCertificateKey(stream nodeattestor.Attest_PluginStream, cert *x509.Certificate) error {
+	challenge, err := common.NewChallenge()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(challenge)
+	if err != nil {
+		return err
+	}
+	if err := stream.Send(&nodeattestor.AttestResponse{Challenge: b}); err != nil {
+		return fmt.Errorf("failed to send challenge: %v", err)
+	}
+	req, err := stream.Recv()
+	if err != nil {
+		return fmt.Errorf("failed to receive challenge response: %v", err)
+	}
+	resp, err := common.ParseChallengeResponse(req.Response)
+	if err != nil {
+		return err
+	}
+	return common.VerifyChallengeResponse(cert, challenge, resp)
+}
+
 func (p *Plugin) assertConfigured() error {
-	if p.config == nil || p.provider == nil || p.verifier == nil {
+	if p.config == nil || p.verifier == nil {
 		return errors.New("plugin not configured")
 	}
 	return nil
@@ -0,0 +1,308 @@
+package nodeattestor
+
+import (
+	"errors"
+	"fmt"
+	"github.com/everpeace/oidc_attestor_plugin/pkg/common"
+	"github.com/everpeace/oidc_attestor_plugin/pkg/config"
+	"github.com/everpeace/oidc_attestor_plugin/pkg/oidcutil"
+	spc "github.com/spiffe/spire/proto/common"
+	"sort"
+	"strings"
+)
+
+var gitHubActionsSelectorClaims = []string{
+	"repository",
+	"repository_owner",
+	"ref",
+	"workflow",
+	"environment",
+	"job_workflow_ref",
+	"runner_environment",
+}
+
+var gitLabCISelectorClaims = []string{
+	"project_path",
+	"namespace_path",
+	"ref",
+	"ref_type",
+	"ref_protected",
+	"environment",
+	"pipeline_source",
+}
+
+// selector name and path of nested claims
+type nestedClaim struct {
+	name string
+	path []string
+}
+
+var kubernetesSelectorClaims = []nestedClaim{
+	{"namespace", []string{"kubernetes.io", "namespace"}},
+	{"serviceaccount_name", []string{"kubernetes.io", "serviceaccount", "name"}},
+	{"serviceaccount_uid", []string{"kubernetes.io", "serviceaccount", "uid"}},
+	{"pod_name", []string{"kubernetes.io", "pod", "name"}},
+	{"pod_uid", []string{"kubernetes.io", "pod", "uid"}},
+	{"node_name", []string{"kubernetes.io", "node", "name"}},
+}
+
+var gceSelectorClaims = []nestedClaim{
+	{"project_id", []string{"google", "compute_engine", "project_id"}},
+	{"zone", []string{"google", "compute_engine", "zone"}},
+	{"instance_id", []string{"google", "compute_engine", "instance_id"}},
+	{"instance_name", []string{"google", "compute_engine", "instance_name"}},
+	{"service_account", []string{"email"}},
+}
+
+var azureSelectorClaims = []string{
+	"tid",
+	"oid",
+	"appid",
+	"xms_mirid",
+}
+
+// Selectors returns selectors of verified claims, and of node id and host facts asserted by the agent.
+func (c *Config) Selectors(claims *oidcutil.Claims, data *common.AttestationData, hmacKey []byte) ([]*spc.Selector, error) {
+	var values []string
+	switch c.Profile {
+	case config.ProfileGitHubActions:
+		if _, ok := claims.Get("repository"); !ok {
+			return nil, errors.New("repository claim must not be empty")
+		}
+		values = append(values, c.issuerSelectorValues(claims)...)
+		values = append(values, claimSelectorValues(claims, gitHubActionsSelectorClaims)...)
+	case config.ProfileGitLabCI:
+		if _, ok := claims.Get("project_path"); !ok {
+			return nil, errors.New("project_path claim must not be empty")
+		}
+		values = append(values, c.issuerSelectorValues(claims)...)
+		values = append(values, claimSelectorValues(claims, gitLabCISelectorClaims)...)
+	case config.ProfileKubernetes:
+		if _, ok := claims.Get("kubernetes.io", "serviceaccount", "name"); !ok {
+			return nil, errors.New("kubernetes.io.serviceaccount.name claim must not be empty")
+		}
+		values = append(values, c.issuerSelectorValues(claims)...)
+		values = append(values, nestedClaimSelectorValues(claims, kubernetesSelectorClaims)...)
+	case config.ProfileGCE:
+		if _, ok := claims.Get("google", "compute_engine", "instance_id"); !ok {
+			return nil, errors.New("google.compute_engine.instance_id claim must not be empty, request token with format=full")
+		}
+		values = append(values, c.issuerSelectorValues(claims)...)
+		values = append(values, nestedClaimSelectorValues(claims, gceSelectorClaims)...)
+	case config.ProfileAzure:
+		resourceID, ok := claims.Get("xms_mirid")
+		if !ok {
+			return nil, errors.New("xms_mirid claim must not be empty, token must be issued to a managed identity")
+		}
+		values = append(values, c.issuerSelectorValues(claims)...)
+		values = append(values, claimSelectorValues(claims, azureSelectorClaims)...)
+		r := common.ParseAzureResourceID(resourceID)
+		if r.Subscription != "" {
+			values = append(values, fmt.Sprintf("subscription:%s", r.Subscription))
+		}
+		if r.ResourceGroup != "" {
+			values = append(values, fmt.Sprintf("resource_group:%s", r.ResourceGroup))
+		}
+		if r.VMName != "" {
+			values = append(values, fmt.Sprintf("vm_name:%s", r.VMName))
+		}
+	default:
+		values = c.oidcSelectorValues(claims)
+	}
+	if claims.Tenant != "" {
+		values = append(values, fmt.Sprintf("tenant:%s", claims.Tenant))
+	}
+	if c.UsesAccessToken() {
+		values = append(values, accessTokenSelectorValues(claims)...)
+	}
+	for _, name := range c.SelectorClaims {
+		vs, _ := claims.GetStrings(name)
+		for _, v := range vs {
+			values = append(values, fmt.Sprintf("%s:%s", name, v))
+		}
+	}
+	if c.UserInfo {
+		values = append(values, c.userInfoSelectorValues(claims)...)
+	}
+	if c.Introspection != nil {
+		values = append(values, claimSelectorValues(claims, append([]string{"username"}, c.Introspection.SelectorClaims...))...)
+	}
+	if data.NodeID != "" {
+		values = append(values, fmt.Sprintf("agent_asserted.node_id:%s", data.NodeID))
+	}
+	values = append(values, c.hostFactSelectorValues(data.HostFacts)...)
+
+	values = c.hashSelectorValues(values, hmacKey)
+
+	selectors := make([]*spc.Selector, 0, len(values))
+	for _, v := range values {
+		selectors = append(selectors, &spc.Selector{
+			Type:  c.SelectorType,
+			Value: v,
+		})
+	}
+	return selectors, nil
+}
+
+func (c *Config) oidcSelectorValues(claims *oidcutil.Claims) []string {
+	values := c.issuerSelectorValues(claims)
+	switch c.Mode {
+	case common.IDGenModeEmail, common.IDGenModeEmailAndNode, common.IDGenModeHashedEmail:
+		// email merged from userinfo isn't asserted by the token, so it is emitted in the form of userinfo selectors
+		prefix := ""
+		if claims.UserInfoClaims["email"] {
+			prefix = "userinfo."
+		}
+		return append(values,
+			fmt.Sprintf("%semail:%s", prefix, claims.Email),
+			fmt.Sprintf("%semail_verified:%v", prefix, claims.EmailVerified),
+		)
+	}
+	return append(values, fmt.Sprintf("subject:%s", claims.Subject))
+}
+
+// emitsEmailSelectors reports whether oidcSelectorValues emits email selectors instead of subject.
+func (c *Config) emitsEmailSelectors() bool {
+	return c.Profile == config.ProfileOIDC && c.RequiresEmail()
+}
+
+// issuerSelectorValues returns "issuer:<issuer alias>" when the alias is configured, otherwise "issuer:<issuer url>".
+// The alias of a multi-tenant issuer stands for all of its tenants, so "issuer:<issuer alias>/tenant/<tenant>" is returned for it.
+// legacy_issuer_selectors emits both forms while selector entries are migrated to the alias.
+func (c *Config) issuerSelectorValues(claims *oidcutil.Claims) []string {
+	legacy := fmt.Sprintf("issuer:%s", claims.Issuer)
+	if c.IssuerAlias == "" {
+		return []string{legacy}
+	}
+	alias := fmt.Sprintf("issuer:%s", c.IssuerAlias)
+	if claims.Tenant != "" {
+		alias = fmt.Sprintf("issuer:%s/tenant/%s", c.IssuerAlias, claims.Tenant)
+	}
+	if c.LegacyIssuerSelectors {
+		return []string{alias, legacy}
+	}
+	return []string{alias}
+}
+
+// accessTokenSelectorValues returns authorization data of access tokens (RFC 9068).
+func accessTokenSelectorValues(claims *oidcutil.Claims) []string {
+	values := []string{fmt.Sprintf("client_id:%s", claims.ClientID)}
+	for _, scope := range claims.Scopes() {
+		values = append(values, fmt.Sprintf("scope:%s", scope))
+	}
+	roles, _ := claims.GetStrings("roles")
+	for _, role := range roles {
+		values = append(values, fmt.Sprintf("role:%s", role))
+	}
+	return values
+}
+
+// userInfoSelectorValues returns "userinfo.<name>:<value>" for claims merged from the UserInfo endpoint,
+// so that they are distinguished from claims asserted in the token.
+func (c *Config) userInfoSelectorValues(claims *oidcutil.Claims) []string {
+	names := c.UserInfoSelectorClaims
+	if len(names) == 0 {
+		for name := range claims.UserInfoClaims {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var values []string
+	for _, name := range names {
+		if !claims.UserInfoClaims[name] {
+			continue
+		}
+		// emitted by oidcSelectorValues with the canonicalized email
+		if c.emitsEmailSelectors() && (name == "email" || name == "email_verified") {
+			continue
+		}
+		vs, _ := claims.GetStrings(name)
+		for _, v := range vs {
+			values = append(values, fmt.Sprintf("userinfo.%s:%s", name, v))
+		}
+	}
+	return values
+}
+
+// selectors which identify users, hashed by selector_hashing.
+// names are of the final selectors, so that claims emitted by selector_claims or introspection are covered too.
+var hashedSelectorNames = map[string]bool{
+	"subject":            true,
+	"sub":                true,
+	"email":              true,
+	"username":           true,
+	"preferred_username": true,
+	"upn":                true,
+	"unique_name":        true,
+	"name":               true,
+	"oid":                true,
+	"service_account":    true,
+}
+
+// isHashedSelectorName reports whether selectors of the name identify users.
+// all of "userinfo.<name>" selectors are hashed, since the UserInfo endpoint returns the user's profile.
+func isHashedSelectorName(name string) bool {
+	return hashedSelectorNames[name] || strings.HasPrefix(name, "userinfo.")
+}
+
+// hashSelectorValues adds "<name>_hmac:<hmac of value>" for identifying selectors,
+// and removes the raw ones when selector_hashing is only.
+func (c *Config) hashSelectorValues(values []string, hmacKey []byte) []string {
+	if !c.HashesSelectors() {
+		return values
+	}
+	var hashed []string
+	for _, v := range values {
+		kv := strings.SplitN(v, ":", 2)
+		if len(kv) != 2 || !isHashedSelectorName(kv[0]) {
+			hashed = append(hashed, v)
+			continue
+		}
+		if c.SelectorHashing == SelectorHashingBoth {
+			hashed = append(hashed, v)
+		}
+		hashed = append(hashed, fmt.Sprintf("%s_hmac:%s", kv[0], common.HashIdentifier(hmacKey, kv[1])))
+	}
+	return hashed
+}
+
+// hostFactSelectorValues returns "agent_asserted.host.<name>:<value>" for enabled host facts.
+// The prefix marks them as asserted by the agent, which the issuer doesn't vouch for.
+func (c *Config) hostFactSelectorValues(hostFacts map[string]string) []string {
+	var values []string
+	for _, name := range c.HostFacts {
+		v, ok := hostFacts[name]
+		if !ok || v == "" {
+			continue
+		}
+		if name == common.HostFactMACAddresses {
+			for _, mac := range strings.Split(v, ",") {
+				values = append(values, fmt.Sprintf("agent_asserted.host.%s:%s", name, mac))
+			}
+			continue
+		}
+		values = append(values, fmt.Sprintf("agent_asserted.host.%s:%s", name, v))
+	}
+	return values
+}
+
+// claimSelectorValues returns "<name>:<value>" for each of names present in claims.
+func claimSelectorValues(claims *oidcutil.Claims, names []string) []string {
+	var values []string
+	for _, name := range names {
+		if v, ok := claims.Get(name); ok && v != "" {
+			values = append(values, fmt.Sprintf("%s:%s", name, v))
+		}
+	}
+	return values
+}
+
+func nestedClaimSelectorValues(claims *oidcutil.Claims, nested []nestedClaim) []string {
+	var values []string
+	for _, nc := range nested {
+		if v, ok := claims.Get(nc.path...); ok && v != "" {
+			values = append(values, fmt.Sprintf("%s:%s", nc.name, v))
+		}
+	}
+	return values
+}